@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// Search scopes
+const (
+	ScopeBase = "base"
+	ScopeOne  = "one"
+	ScopeSub  = "sub"
+)
+
+// Alias dereferencing policies
+const (
+	DerefNever     = "never"
+	DerefSearching = "searching"
+	DerefFinding   = "finding"
+	DerefAlways    = "always"
+)
+
+var (
+	searchScopes = map[string]int{
+		ScopeBase: ldap.ScopeBaseObject,
+		ScopeOne:  ldap.ScopeSingleLevel,
+		ScopeSub:  ldap.ScopeWholeSubtree,
+	}
+	derefPolicies = map[string]int{
+		DerefNever:     ldap.NeverDerefAliases,
+		DerefSearching: ldap.DerefInSearching,
+		DerefFinding:   ldap.DerefFindingBaseObj,
+		DerefAlways:    ldap.DerefAlways,
+	}
+)
+
+// BaseDn is a base DN searched for the objects of a target group.  It can be written as a plain
+// DN string, in which case its whole subtree is searched with the filter of the target group.
+type BaseDn struct {
+	DN string `yaml:"dn"`
+	// Scope is the search scope: base, one or sub (default)
+	Scope string `yaml:"scope,omitempty"`
+	// DerefAliases is the alias dereferencing policy: never (default), searching, finding or always
+	DerefAliases string `yaml:"deref_aliases,omitempty"`
+	// Filter overrides the filter of the target group for the searches of this base DN
+	Filter string `yaml:"filter,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface so that base DNs can be written as
+// plain strings
+func (b *BaseDn) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var dn string
+	if err := unmarshal(&dn); err == nil {
+		*b = BaseDn{DN: dn}
+		return nil
+	}
+	type plain BaseDn
+	return unmarshal((*plain)(b))
+}
+
+// MarshalYAML implements the yaml.Marshaler interface, writing base DNs with default options as
+// plain strings
+func (b BaseDn) MarshalYAML() (interface{}, error) {
+	if (b.Scope == "" || b.Scope == ScopeSub) && (b.DerefAliases == "" || b.DerefAliases == DerefNever) && b.Filter == "" {
+		return b.DN, nil
+	}
+	type plain BaseDn
+	return plain(b), nil
+}
+
+// Validate ensures the base DN and its options are valid and sets the default values
+func (b *BaseDn) Validate(path string) error {
+	if strings.TrimSpace(b.DN) == "" {
+		return fmt.Errorf("%s.dn must be set", path)
+	}
+	if _, err := ldap.ParseDN(b.DN); err != nil {
+		return fmt.Errorf("%s.dn is not a valid DN: %v", path, err)
+	}
+	if b.Scope == "" {
+		b.Scope = ScopeSub
+	}
+	if _, ok := searchScopes[b.Scope]; !ok {
+		return fmt.Errorf("%s.scope must be one of base, one or sub", path)
+	}
+	if b.DerefAliases == "" {
+		b.DerefAliases = DerefNever
+	}
+	if _, ok := derefPolicies[b.DerefAliases]; !ok {
+		return fmt.Errorf("%s.deref_aliases must be one of never, searching, finding or always", path)
+	}
+	return validateFilter(path+".filter", b.Filter)
+}
+
+// SearchScope returns the ldap search scope of the base DN
+func (b *BaseDn) SearchScope() int {
+	if scope, ok := searchScopes[b.Scope]; ok {
+		return scope
+	}
+	return ldap.ScopeWholeSubtree
+}
+
+// DerefPolicy returns the ldap alias dereferencing policy of the base DN
+func (b *BaseDn) DerefPolicy() int {
+	if deref, ok := derefPolicies[b.DerefAliases]; ok {
+		return deref
+	}
+	return ldap.NeverDerefAliases
+}
+
+// Contains returns true if the DN is within the search scope of the base DN
+func (b *BaseDn) Contains(dn string) bool {
+	base, err := ldap.ParseDN(b.DN)
+	if err != nil {
+		return false
+	}
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return false
+	}
+	switch b.SearchScope() {
+	case ldap.ScopeBaseObject:
+		return base.EqualFold(parsed)
+	case ldap.ScopeSingleLevel:
+		return len(parsed.RDNs) == len(base.RDNs)+1 && base.AncestorOfFold(parsed)
+	}
+	return base.EqualFold(parsed) || base.AncestorOfFold(parsed)
+}
@@ -4,17 +4,31 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"sync/atomic"
 
 	"gopkg.in/yaml.v2"
 )
 
-var GlobalConfig *Config
+// globalConfig holds the current configuration, which is replaced by the reloads
+var globalConfig atomic.Pointer[Config]
+
+// GlobalConfig returns the current configuration
+func GlobalConfig() *Config {
+	return globalConfig.Load()
+}
+
+// SetGlobalConfig replaces the current configuration
+func SetGlobalConfig(c *Config) {
+	globalConfig.Store(c)
+}
 
 // Config is the top level configuration used by the service discovery module
 type Config struct {
 	Host       string      `yaml:"server_host" json:"server_host"`
 	Port       int         `yaml:"server_port" json:"server_port"`
 	LdapConfig *LdapConfig `yaml:"ldap_config" json:"ldap_config"`
+	// DisableConfigEndpoint disables the /config endpoint, which exposes the effective configuration
+	DisableConfigEndpoint bool `yaml:"disable_config_endpoint" json:"disable_config_endpoint"`
 }
 
 // NewConfig constructs a new Config instance
@@ -37,15 +51,6 @@ func NewConfig(configPath string) (*Config, error) {
 	return c, nil
 }
 
-// Serialize serializes the configuration so that it can be printed and viewed
-func (c *Config) Serialize() (string, error) {
-	if b, err := yaml.Marshal(c); err != nil {
-		return "", err
-	} else {
-		return string(b), nil
-	}
-}
-
 func (c *Config) Validate() error {
 	if c.Host == "" {
 		c.Host = "127.0.0.1" // default value
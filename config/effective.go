@@ -0,0 +1,265 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Redacted replaces the values of the secret fields, tagged with secret:"true", in the served
+// configuration
+const Redacted = "<redacted>"
+
+// GroupFilter is the effective filter used to search a base DN of a target group or group template
+type GroupFilter struct {
+	BaseDn string `yaml:"base_dn,omitempty"`
+	Filter string `yaml:"filter"`
+}
+
+// mappingFilters returns the effective filters of a target group, one per base DN or a single one
+// without base DN when none are set
+func (c *LdapConfig) mappingFilters(m *BaseDnMapping) ([]GroupFilter, error) {
+	if len(m.BaseDnList) == 0 {
+		f, err := c.EffectiveFilter(m, nil)
+		if err != nil {
+			return nil, err
+		}
+		return []GroupFilter{{Filter: f.String()}}, nil
+	}
+	list := make([]GroupFilter, 0, len(m.BaseDnList))
+	for _, baseDn := range m.BaseDnList {
+		f, err := c.EffectiveFilter(m, baseDn)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, GroupFilter{BaseDn: baseDn.DN, Filter: f.String()})
+	}
+	return list, nil
+}
+
+// EffectiveFilters returns the effective filters of each target group and group template, one per
+// base DN or a single one without base DN when none are set
+func (c *LdapConfig) EffectiveFilters() (groups map[string][]GroupFilter, templates map[string][]GroupFilter, err error) {
+	groups = map[string][]GroupFilter{}
+	for name, m := range c.BaseDnMappings {
+		if groups[name], err = c.mappingFilters(m); err != nil {
+			return nil, nil, fmt.Errorf("base_dn_mappings.%s: %v", name, err)
+		}
+	}
+	templates = map[string][]GroupFilter{}
+	for name, t := range c.GroupTemplates {
+		f, err := c.EffectiveFilter(t.Mapping, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("group_templates.%s: %v", name, err)
+		}
+		templates[name] = []GroupFilter{{Filter: f.String()}}
+	}
+	return groups, templates, nil
+}
+
+// Effective returns the configuration after defaults, with the secret fields redacted, the cache
+// directory resolved to an absolute path and the effective filters of the target groups, including
+// the given target groups generated by the group templates
+func (c *Config) Effective(generated map[string]*BaseDnMapping) (yaml.MapSlice, error) {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var effective yaml.MapSlice
+	if err := yaml.Unmarshal(b, &effective); err != nil {
+		return nil, err
+	}
+	for _, path := range secretPaths(reflect.TypeOf(c), nil, map[reflect.Type]bool{}) {
+		effective = redactPath(effective, path).(yaml.MapSlice)
+	}
+
+	if c.LdapConfig == nil {
+		return effective, nil
+	}
+	if dir, err := filepath.Abs(c.LdapConfig.CacheDir); err == nil {
+		effective = setPath(effective, []string{"ldap_config", "cache_dir"}, dir)
+	}
+
+	groups, templates, err := c.LdapConfig.EffectiveFilters()
+	if err != nil {
+		return nil, err
+	}
+	generatedGroups := map[string][]GroupFilter{}
+	for name, m := range generated {
+		if generatedGroups[name], err = c.LdapConfig.mappingFilters(m); err != nil {
+			return nil, fmt.Errorf("generated target group %s: %v", name, err)
+		}
+	}
+	filters := yaml.MapSlice{
+		{Key: "target_groups", Value: sortedFilters(groups)},
+		{Key: "group_templates", Value: sortedFilters(templates)},
+		{Key: "generated_target_groups", Value: sortedFilters(generatedGroups)},
+	}
+	return append(effective, yaml.MapItem{Key: "effective_filters", Value: filters}), nil
+}
+
+// Serialize serializes the effective configuration as YAML so that it can be printed and viewed
+func (c *Config) Serialize(generated map[string]*BaseDnMapping) (string, error) {
+	effective, err := c.Effective(generated)
+	if err != nil {
+		return "", err
+	}
+	b, err := yaml.Marshal(effective)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// SerializeJSON serializes the effective configuration as JSON
+func (c *Config) SerializeJSON(generated map[string]*BaseDnMapping) (string, error) {
+	effective, err := c.Effective(generated)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(jsonValue(effective)); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+func sortedFilters(filters map[string][]GroupFilter) yaml.MapSlice {
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sorted := yaml.MapSlice{}
+	for _, name := range names {
+		list := make([]yaml.MapSlice, 0, len(filters[name]))
+		for _, f := range filters[name] {
+			item := yaml.MapSlice{}
+			if f.BaseDn != "" {
+				item = append(item, yaml.MapItem{Key: "base_dn", Value: f.BaseDn})
+			}
+			list = append(list, append(item, yaml.MapItem{Key: "filter", Value: f.Filter}))
+		}
+		sorted = append(sorted, yaml.MapItem{Key: name, Value: list})
+	}
+	return sorted
+}
+
+// secretPaths returns the YAML paths of the fields tagged with secret:"true" in the type, "*"
+// matching any map key or slice index
+func secretPaths(t reflect.Type, prefix []string, visiting map[reflect.Type]bool) [][]string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return secretPaths(t.Elem(), prefix, visiting)
+	case reflect.Map, reflect.Slice, reflect.Array:
+		return secretPaths(t.Elem(), append(append([]string{}, prefix...), "*"), visiting)
+	case reflect.Struct:
+	default:
+		return nil
+	}
+	if visiting[t] {
+		return nil
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	paths := [][]string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		path := append([]string{}, prefix...)
+		if len(tag) > 1 && tag[1] == "inline" {
+			paths = append(paths, secretPaths(field.Type, path, visiting)...)
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		path = append(path, name)
+		if field.Tag.Get("secret") == "true" {
+			paths = append(paths, path)
+			continue
+		}
+		paths = append(paths, secretPaths(field.Type, path, visiting)...)
+	}
+	return paths
+}
+
+// redactPath replaces the non-empty values at the path of the decoded YAML value with Redacted
+func redactPath(value interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		if value == nil || value == "" {
+			return value
+		}
+		return Redacted
+	}
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			if path[0] == "*" || fmt.Sprint(item.Key) == path[0] {
+				v[i].Value = redactPath(item.Value, path[1:])
+			}
+		}
+	case []interface{}:
+		if path[0] == "*" {
+			for i := range v {
+				v[i] = redactPath(v[i], path[1:])
+			}
+		}
+	}
+	return value
+}
+
+// setPath sets the value at the path of the decoded YAML mapping, if the path exists
+func setPath(m yaml.MapSlice, path []string, value interface{}) yaml.MapSlice {
+	for i, item := range m {
+		if fmt.Sprint(item.Key) != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			m[i].Value = value
+		} else if child, ok := item.Value.(yaml.MapSlice); ok {
+			m[i].Value = setPath(child, path[1:], value)
+		}
+	}
+	return m
+}
+
+// jsonValue converts a decoded YAML value to a value which can be encoded as JSON
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{}, len(v))
+		for _, item := range v {
+			m[fmt.Sprint(item.Key)] = jsonValue(item.Value)
+		}
+		return m
+	case []yaml.MapSlice:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			list = append(list, jsonValue(item))
+		}
+		return list
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			list = append(list, jsonValue(item))
+		}
+		return list
+	}
+	return value
+}
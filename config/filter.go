@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/filter"
+)
+
+// DefaultFilter is the filter used when neither the global filter nor the target group filter is set
+const DefaultFilter = "(objectClass=computer)"
+
+// validateFilter ensures the filter, if set, is a valid LDAP filter
+func validateFilter(path, f string) error {
+	if f == "" {
+		return nil
+	}
+	if _, err := filter.Parse(f); err != nil {
+		return fmt.Errorf("%s is invalid: %v", path, err)
+	}
+	return nil
+}
+
+// parseFilter returns the parsed filter, or nil if it's empty
+func parseFilter(f string) (filter.Filter, error) {
+	if f == "" {
+		return nil, nil
+	}
+	return filter.Parse(f)
+}
+
+// EffectiveFilter returns the filter used to search a base DN of a target group: the global filter
+// combined with the filter of the base DN or, when it isn't set, the filter of the target group.
+// The default filter is used when none of them are set.  The base DN may be nil.  An error is
+// returned if one of the filters is invalid, rather than searching with a broader filter.
+func (c *LdapConfig) EffectiveFilter(m *BaseDnMapping, baseDn *BaseDn) (filter.Filter, error) {
+	groupFilter := m.Filter
+	if baseDn != nil && baseDn.Filter != "" {
+		groupFilter = baseDn.Filter
+	}
+	global, err := parseFilter(c.Filter)
+	if err != nil {
+		return nil, err
+	}
+	group, err := parseFilter(groupFilter)
+	if err != nil {
+		return nil, err
+	}
+	if f := filter.Combine(global, group); f != nil {
+		return f, nil
+	}
+	return filter.MustParse(DefaultFilter), nil
+}
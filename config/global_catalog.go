@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Global Catalog ports
+const (
+	GlobalCatalogPort    = "3268"
+	GlobalCatalogTLSPort = "3269"
+)
+
+// globalCatalogAttributes are the attributes of computer objects which are part of the default
+// partial attribute set replicated to the Global Catalog.  Constructed attributes such as
+// canonicalName are computed by the Global Catalog server and are included as well.
+var globalCatalogAttributes = []string{
+	"canonicalName",
+	"cn",
+	"description",
+	"displayName",
+	"distinguishedName",
+	"dNSHostName",
+	"managedBy",
+	"memberOf",
+	"name",
+	"objectCategory",
+	"objectClass",
+	"objectGUID",
+	"objectSid",
+	"operatingSystem",
+	"operatingSystemServicePack",
+	"operatingSystemVersion",
+	"primaryGroupID",
+	"sAMAccountName",
+	"sAMAccountType",
+	"servicePrincipalName",
+	"userAccountControl",
+	"userPrincipalName",
+	"whenChanged",
+	"whenCreated",
+}
+
+// GlobalCatalog searches the ActiveDirectory Global Catalog, which holds a partial replica of
+// every object of the forest, so that a single target group covers every domain
+type GlobalCatalog struct {
+	// Server is the Global Catalog server as host:port.  Defaults to the host of the configured
+	// server on port 3268, or on port 3269 (LDAPS) when the configured server uses port 636.
+	Server string `yaml:"server"`
+	// ReplicatedAttributes are the attributes added to the partial attribute set of the forest,
+	// on top of the default ones
+	ReplicatedAttributes []string `yaml:"replicated_attributes"`
+}
+
+// Validate ensures the Global Catalog options are valid
+func (g *GlobalCatalog) Validate(path string) error {
+	if _, port, err := net.SplitHostPort(g.Server); err != nil || port == "" {
+		return fmt.Errorf("%s.server must be set to a valid address (format: <GC_HOST>:<GC_PORT>)", path)
+	}
+	return nil
+}
+
+// URL returns the LDAP URL of the Global Catalog server, using LDAPS on port 3269
+func (g *GlobalCatalog) URL() string {
+	if _, port, _ := net.SplitHostPort(g.Server); port == GlobalCatalogTLSPort {
+		return "ldaps://" + g.Server
+	}
+	return "ldap://" + g.Server
+}
+
+// GlobalCatalogURLs returns the LDAP URLs of the Global Catalog servers searched by the target
+// groups and group templates
+func (c *LdapConfig) GlobalCatalogURLs() map[string]bool {
+	urls := map[string]bool{}
+	for _, m := range c.BaseDnMappings {
+		if m.GlobalCatalog != nil {
+			urls[m.GlobalCatalog.URL()] = true
+		}
+	}
+	for _, t := range c.GroupTemplates {
+		if t.Mapping != nil && t.Mapping.GlobalCatalog != nil {
+			urls[t.Mapping.GlobalCatalog.URL()] = true
+		}
+	}
+	return urls
+}
+
+// globalCatalogServer returns the default Global Catalog server for the configured server
+func (c *LdapConfig) globalCatalogServer() string {
+	host, port, err := net.SplitHostPort(c.URL)
+	if err != nil {
+		host = c.URL
+	}
+	if port == "636" {
+		return net.JoinHostPort(host, GlobalCatalogTLSPort)
+	}
+	return net.JoinHostPort(host, GlobalCatalogPort)
+}
+
+// NonReplicatedAttributes returns the sorted attributes requested by a target group searching the
+// Global Catalog which aren't part of its partial attribute set, and so are never returned
+func (c *LdapConfig) NonReplicatedAttributes(m *BaseDnMapping) []string {
+	if m.GlobalCatalog == nil {
+		return nil
+	}
+	replicated := map[string]bool{}
+	for _, attrib := range append(append([]string{}, globalCatalogAttributes...), m.GlobalCatalog.ReplicatedAttributes...) {
+		replicated[strings.ToLower(attrib)] = true
+	}
+
+	seen := map[string]bool{}
+	missing := []string{}
+	for _, attrib := range append(append(append([]string{}, c.DefaultAttributes...), m.Attributes...), m.RequiredAttributes()...) {
+		if replicated[strings.ToLower(attrib)] || seen[strings.ToLower(attrib)] {
+			continue
+		}
+		seen[strings.ToLower(attrib)] = true
+		missing = append(missing, attrib)
+	}
+	sort.Strings(missing)
+	return missing
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/filter"
+	"github.com/prometheus/common/model"
+)
+
+const defaultGroupTemplateRefreshInterval = model.Duration(5 * time.Minute)
+
+// GroupTemplate generates target groups dynamically, either one per distinct value of an attribute
+// or one per child OU of a base DN.  The generated groups are refreshed periodically so that new
+// values and OUs are served without a configuration change.
+type GroupTemplate struct {
+	// Name is the template rendering the name of each generated group.  The attribute value is
+	// available as {{ .value }}, and the name and DN of the child OU as {{ .ou }} and {{ .dn }}.
+	Name string `yaml:"name"`
+	// Attribute is the attribute of which each distinct value generates a group, the objects
+	// being searched with the base DNs and filter of the mapping
+	Attribute string `yaml:"attribute"`
+	// ChildOUsOf is the base DN of which each child OU generates a group
+	ChildOUsOf string `yaml:"child_ous_of"`
+	// RefreshInterval is the interval at which the generated groups are refreshed (default is 5m)
+	RefreshInterval model.Duration `yaml:"refresh_interval"`
+	// Mapping is the target group configuration shared by the generated groups
+	Mapping      *BaseDnMapping `yaml:"mapping"`
+	nameTemplate *template.Template
+}
+
+// Validate ensures the group template is valid and sets the default values
+func (t *GroupTemplate) Validate(name string) error {
+	if strings.TrimSpace(t.Name) == "" {
+		return fmt.Errorf("group_templates.%s.name must be set", name)
+	}
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(t.Name)
+	if err != nil {
+		return fmt.Errorf("group_templates.%s.name is invalid: %v", name, err)
+	}
+	t.nameTemplate = tmpl
+
+	if (t.Attribute == "") == (t.ChildOUsOf == "") {
+		return fmt.Errorf("group_templates.%s must set exactly one of attribute or child_ous_of", name)
+	}
+	if t.ChildOUsOf != "" {
+		if _, err := ldap.ParseDN(t.ChildOUsOf); err != nil {
+			return fmt.Errorf("group_templates.%s.child_ous_of is not a valid DN: %v", name, err)
+		}
+	}
+	if t.RefreshInterval < 0 {
+		return fmt.Errorf("group_templates.%s.refresh_interval must not be negative", name)
+	}
+	if t.RefreshInterval == 0 {
+		t.RefreshInterval = defaultGroupTemplateRefreshInterval
+	}
+
+	if t.Mapping == nil {
+		return fmt.Errorf("group_templates.%s.mapping must be set", name)
+	}
+	if t.Attribute != "" && len(t.Mapping.BaseDnList) == 0 && t.Mapping.Filter == "" {
+		return fmt.Errorf("group_templates.%s.mapping must set base_dn_list or filter to search the attribute values", name)
+	}
+	if err := validateFilter(fmt.Sprintf("group_templates.%s.mapping.filter", name), t.Mapping.Filter); err != nil {
+		return err
+	}
+	// The generated groups set the base DN or filter of the mapping, so the mapping is validated
+	// as a generated group before its defaults are kept for the following ones
+	var mapping *BaseDnMapping
+	if t.ChildOUsOf != "" {
+		mapping, err = t.mappingFor(t.ChildOUsOf, "")
+	} else {
+		mapping, err = t.mappingFor("", "value")
+	}
+	if err != nil {
+		return fmt.Errorf("group_templates.%s.mapping: %v", name, err)
+	}
+	if err := mapping.Validate(name); err != nil {
+		return fmt.Errorf("group_templates.%s.mapping: %v", name, err)
+	}
+	mapping.BaseDnList = t.Mapping.BaseDnList
+	mapping.Filter = t.Mapping.Filter
+	*t.Mapping = *mapping
+	return nil
+}
+
+// RenderName renders the name of the group generated from an attribute value, or from the child OU
+// with the given DN
+func (t *GroupTemplate) RenderName(value, dn string) (string, error) {
+	data := map[string]string{"value": value, "dn": dn}
+	if dn != "" {
+		if parsed, err := ldap.ParseDN(dn); err == nil && len(parsed.RDNs) > 0 && len(parsed.RDNs[0].Attributes) > 0 {
+			data["ou"] = parsed.RDNs[0].Attributes[0].Value
+		}
+	}
+	var b strings.Builder
+	if err := t.nameTemplate.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// Generate returns the configuration of the group generated from an attribute value, or from the
+// child OU with the given DN.  The template must have been validated.
+func (t *GroupTemplate) Generate(value, dn string) (*BaseDnMapping, error) {
+	return t.mappingFor(dn, value)
+}
+
+// mappingFor returns a copy of the mapping restricted to the child OU or attribute value
+func (t *GroupTemplate) mappingFor(dn, value string) (*BaseDnMapping, error) {
+	m := *t.Mapping
+	if t.ChildOUsOf != "" {
+		m.BaseDnList = []*BaseDn{{DN: dn, Scope: ScopeSub, DerefAliases: DerefNever}}
+		return &m, nil
+	}
+	mappingFilter, err := parseFilter(m.Filter)
+	if err != nil {
+		return nil, err
+	}
+	valueFilter := filter.Comparison{Attr: t.Attribute, Op: "=", Value: ldap.EscapeFilter(value)}
+	m.Filter = filter.Combine(mappingFilter, valueFilter).String()
+	// The filter of a base DN replaces the filter of the mapping, so the value filter is added to it
+	m.BaseDnList = make([]*BaseDn, len(t.Mapping.BaseDnList))
+	for i, baseDn := range t.Mapping.BaseDnList {
+		b := *baseDn
+		if b.Filter != "" {
+			baseDnFilter, err := parseFilter(b.Filter)
+			if err != nil {
+				return nil, err
+			}
+			b.Filter = filter.Combine(baseDnFilter, valueFilter).String()
+		}
+		m.BaseDnList[i] = &b
+	}
+	return &m, nil
+}
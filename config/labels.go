@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const metaLabelPrefix = "__meta_ldap_"
+
+// builtinLabels are the labels set by the discovery itself, such as when resolving or probing the
+// targets, which would silently override the labels of the attributes sharing their name
+var builtinLabels = []string{
+	metaLabelPrefix + "exporter_port_name",
+	metaLabelPrefix + "hostname",
+	metaLabelPrefix + "dns_resolved",
+	metaLabelPrefix + "exporter_reachable",
+}
+
+var (
+	labelNameRE        = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	invalidLabelCharRE = regexp.MustCompile("[^a-zA-Z0-9_]")
+	repeatedUnderscore = regexp.MustCompile("_{2,}")
+	matchFirstCap      = regexp.MustCompile("(.)([A-Z][a-z]+)")
+	matchAllCap        = regexp.MustCompile("([a-z0-9])([A-Z])")
+)
+
+// AttributeLabelName converts an LDAP attribute name to the snake case name used for its label,
+// without the __meta_ldap_ prefix.  Characters which aren't allowed in prometheus label names,
+// such as the dash in msDS-SupportedEncryptionTypes, are replaced by underscores.
+func AttributeLabelName(attrib string) string {
+	snake := matchFirstCap.ReplaceAllString(attrib, "${1}_${2}")
+	snake = matchAllCap.ReplaceAllString(snake, "${1}_${2}")
+	snake = invalidLabelCharRE.ReplaceAllString(snake, "_")
+	snake = repeatedUnderscore.ReplaceAllString(snake, "_")
+	return strings.Trim(strings.ToLower(snake), "_")
+}
+
+// validateLabels ensures the names of a set of static labels are valid prometheus label names
+func validateLabels(path string, labels map[string]string) error {
+	for k := range labels {
+		if !labelNameRE.MatchString(k) {
+			return fmt.Errorf("%s: %q is not a valid label name", path, k)
+		}
+	}
+	return nil
+}
+
+// validateAttributeLabelNames ensures that no two attributes are exposed with the same label name
+func validateAttributeLabelNames(path string, attributes []string) error {
+	seen := map[string]string{}
+	for _, attrib := range attributes {
+		name := AttributeLabelName(attrib)
+		if name == "" {
+			return fmt.Errorf("%s: attribute %q can't be converted to a label name", path, attrib)
+		}
+		if other, ok := seen[name]; ok && other != attrib {
+			return fmt.Errorf("%s: attributes %q and %q would both be exposed as label __meta_ldap_%s", path, other, attrib, name)
+		}
+		seen[name] = attrib
+	}
+	return nil
+}
+
+// validateLabelNames ensures that no two sources of labels of the target group, being its
+// attributes, the flags of the decoded userAccountControl attributes, the DN labels, the static
+// labels and the built-in labels, are exposed with the same label name
+func (c *LdapConfig) validateLabelNames(path string, m *BaseDnMapping) error {
+	attributes := append(append([]string{}, c.DefaultAttributes...), m.Attributes...)
+	if err := validateAttributeLabelNames(path+".attributes", attributes); err != nil {
+		return err
+	}
+
+	seen := map[string]string{}
+	add := func(label, source string) error {
+		if other, ok := seen[label]; ok && other != source {
+			return fmt.Errorf("%s: %s and %s would both be exposed as label %s", path, other, source, label)
+		}
+		seen[label] = source
+		return nil
+	}
+	for _, label := range builtinLabels {
+		seen[label] = "built-in label"
+	}
+
+	for _, attrib := range attributes {
+		label := metaLabelPrefix + AttributeLabelName(attrib)
+		labels := []string{label}
+		if c.AttributeDecoding(attrib, m.AttributeOptions[attrib]) == DecodeUAC {
+			labels = append(labels, label+"_flags", label+"_disabled")
+		}
+		for _, l := range labels {
+			if err := add(l, fmt.Sprintf("attribute %q", attrib)); err != nil {
+				return err
+			}
+		}
+	}
+
+	options := make([]string, 0, len(m.AttributeOptions))
+	for attrib := range m.AttributeOptions {
+		options = append(options, attrib)
+	}
+	sort.Strings(options)
+	for _, attrib := range options {
+		for i, l := range m.AttributeOptions[attrib].DnLabels {
+			if err := add(metaLabelPrefix+l.LabelName(attrib), fmt.Sprintf("attribute_options.%s.dn_labels[%d]", attrib, i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The static labels of the target group override the global ones so they don't collide
+	static := []string{}
+	for name := range c.Labels {
+		static = append(static, name)
+	}
+	for name := range m.Labels {
+		static = append(static, name)
+	}
+	sort.Strings(static)
+	for _, name := range static {
+		if err := add(name, fmt.Sprintf("static label %q", name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
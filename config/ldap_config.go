@@ -4,13 +4,21 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
 )
 
 // LdapConfig is the configuration used to specify the properties of the LDAP queries
 type LdapConfig struct {
 	URL                  string                    `yaml:"server"`
-	BindDN               string                    `yaml:"bind_dn"`
+	BindDN               string                    `yaml:"bind_dn" secret:"true"`
 	BaseDnMappings       map[string]*BaseDnMapping `yaml:"base_dn_mappings"`
+	GroupTemplates       map[string]*GroupTemplate `yaml:"group_templates"`
 	Filter               string                    `yaml:"filter"`
 	DefaultAttributes    []string                  `yaml:"default_attributes"`
 	PasswordEnvVar       string                    `yaml:"password_env_var"`
@@ -18,16 +26,366 @@ type LdapConfig struct {
 	Unsecured            bool                      `yaml:"unsecured"`
 	CacheDir             string                    `yaml:"cache_dir"`
 	CacheTTL             int                       `yaml:"cache_ttl"`
-	MaxReconnectAttempts int
+	Labels               map[string]string         `yaml:"labels"`
+	MaxLabelValueLength  int                       `yaml:"max_label_value_length"`
+	InvalidUTF8Values    string                    `yaml:"invalid_utf8_values"`
+	Referrals            *Referrals                `yaml:"referrals"`
+	DecodeADAttributes   bool                      `yaml:"decode_ad_attributes"`
+	MaxReconnectAttempts int                       `yaml:"-"`
+}
+
+// Referrals defines how the referrals returned by searches, such as for the child domains of a
+// forest, are followed.  The referred servers are bound to with the configured credentials.
+type Referrals struct {
+	// Follow enables following the referrals
+	Follow bool `yaml:"follow"`
+	// MaxHops is the maximum number of referrals followed in a row from the original search (default 3)
+	MaxHops int `yaml:"max_hops"`
+	// AllowedHosts are the hosts, or the domain suffixes starting with a dot, of the servers which
+	// referrals are followed to.  Only the hosts listed by name are bound to without TLS.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+}
+
+const defaultReferralMaxHops = 3
+
+// AllowsHost returns true if referrals can be followed to the host, as it's one of the allowed hosts
+// or ends with one of the allowed domain suffixes
+func (r *Referrals) AllowsHost(host string) bool {
+	for _, allowed := range r.AllowedHosts {
+		if strings.HasPrefix(allowed, ".") && strings.HasSuffix(strings.ToLower(host), strings.ToLower(allowed)) {
+			return true
+		}
+	}
+	return r.ListsHost(host)
+}
+
+// ListsHost returns true if the host is listed by name in the allowed hosts
+func (r *Referrals) ListsHost(host string) bool {
+	for _, allowed := range r.AllowedHosts {
+		if !strings.HasPrefix(allowed, ".") && strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate ensures the referrals are only followed to the allowed hosts
+func (r *Referrals) Validate() error {
+	if r.MaxHops < 0 {
+		return errors.New("ldap_config.referrals.max_hops must not be negative")
+	}
+	if r.MaxHops == 0 {
+		r.MaxHops = defaultReferralMaxHops
+	}
+	if r.Follow && len(r.AllowedHosts) == 0 {
+		return errors.New("ldap_config.referrals.allowed_hosts must be set when follow is enabled")
+	}
+	for i, host := range r.AllowedHosts {
+		if strings.Trim(host, ".") == "" || strings.ContainsAny(host, ":/ ") {
+			return fmt.Errorf("ldap_config.referrals.allowed_hosts[%d] must be a host or a domain suffix starting with a dot, got %q", i, host)
+		}
+	}
+	return nil
+}
+
+// inheritOptions sets the options which aren't set on the target group to the global ones
+func (c *LdapConfig) inheritOptions(m *BaseDnMapping) {
+	if m.MaxLabelValueLength == 0 {
+		m.MaxLabelValueLength = c.MaxLabelValueLength
+	}
+	if m.InvalidUTF8Values == "" {
+		m.InvalidUTF8Values = c.InvalidUTF8Values
+	}
+	if m.GlobalCatalog != nil && m.GlobalCatalog.Server == "" {
+		m.GlobalCatalog.Server = c.globalCatalogServer()
+	}
 }
 
+// BaseDnMapping is the configuration of a single target group
 type BaseDnMapping struct {
-	BaseDnList   []string `yaml:"base_dn_list"`
-	ExporterPort int      `yaml:"exporter_port"`
-	Attributes   []string `yaml:"attributes"`
-	Filter       string   `yaml:"filter"`
+	BaseDnList            []*BaseDn                    `yaml:"base_dn_list"`
+	ExporterPort          int                          `yaml:"exporter_port"`
+	ExporterPortAttribute string                       `yaml:"exporter_port_attribute"`
+	ExporterPorts         []*ExporterPort              `yaml:"exporter_ports"`
+	AddressTemplate       string                       `yaml:"address_template"`
+	HostnameSources       []*HostnameSource            `yaml:"hostname_sources"`
+	Attributes            []string                     `yaml:"attributes"`
+	Filter                string                       `yaml:"filter"`
+	CoalesceTargets       bool                         `yaml:"coalesce_targets"`
+	Labels                map[string]string            `yaml:"labels"`
+	RelabelConfigs        []*relabel.Config            `yaml:"relabel_configs"`
+	AttributeOptions      map[string]*AttributeOptions `yaml:"attribute_options"`
+	ExcludeDisabled       bool                         `yaml:"exclude_disabled"`
+	ExcludeStale          *StaleFilter                 `yaml:"exclude_stale"`
+	DNSResolution         *DNSResolution               `yaml:"dns_resolution"`
+	ExporterProbe         *ExporterProbe               `yaml:"exporter_probe"`
+	Deduplicate           *Deduplication               `yaml:"deduplicate"`
+	GroupMembership       *GroupMembership             `yaml:"group_membership"`
+	Guardrails            *Guardrails                  `yaml:"guardrails"`
+	OnPartialFailure      string                       `yaml:"on_partial_failure"`
+	GlobalCatalog         *GlobalCatalog               `yaml:"global_catalog"`
+	MaxLabelValueLength   int                          `yaml:"max_label_value_length"`
+	InvalidUTF8Values     string                       `yaml:"invalid_utf8_values"`
+	addressTemplate       *template.Template
+}
+
+// ExporterPort is a named port on which an exporter is listening on each discovered host.
+// When PortAttribute is set, the port is read from that LDAP attribute and Port is only used
+// as a fallback when the attribute is missing or invalid.
+type ExporterPort struct {
+	Name          string `yaml:"name"`
+	Port          int    `yaml:"port"`
+	PortAttribute string `yaml:"port_attribute"`
+}
+
+// HostnameSource is an LDAP attribute from which the hostname of the targets can be read.  The
+// optional Suffix is appended to the value, such as a domain name appended to the name attribute.
+type HostnameSource struct {
+	Attribute string `yaml:"attribute"`
+	Suffix    string `yaml:"suffix"`
+}
+
+// DNSResolution defines the resolution of the target hostnames during the refresh of the group
+type DNSResolution struct {
+	// OnFailure is the handling of hostnames which don't resolve: label (default) or drop
+	OnFailure string `yaml:"on_failure"`
+	// UseIPAddress replaces the hostname by the resolved IP address in the target address
+	UseIPAddress bool `yaml:"use_ip_address"`
+	// Timeout is the timeout of each lookup (default is 2s)
+	Timeout model.Duration `yaml:"timeout"`
+	// Concurrency is the maximum number of concurrent lookups (default is 10)
+	Concurrency int `yaml:"concurrency"`
+}
+
+// ExporterProbe defines the probing of the exporter of each target during the refresh of the group
+type ExporterProbe struct {
+	// Method is the probe method: tcp (default) to open a connection or http to GET the Path
+	Method string `yaml:"method"`
+	// Path is the path requested by the http method (default is /metrics)
+	Path string `yaml:"path"`
+	// Timeout is the timeout of each probe (default is 2s)
+	Timeout model.Duration `yaml:"timeout"`
+	// Concurrency is the maximum number of concurrent probes (default is 10)
+	Concurrency int `yaml:"concurrency"`
+}
+
+// Guardrails protect the targets of the group against refreshes returning obviously wrong results,
+// such as a partially failing or misconfigured search.  A rejected refresh keeps the previous objects.
+type Guardrails struct {
+	// MaxShrinkPercent rejects a refresh which removes more than this percentage of the previous
+	// objects (0 disables the check)
+	MaxShrinkPercent float64 `yaml:"max_shrink_percent"`
+	// MaxObjects rejects a refresh which discovers more objects than this (0 disables the check)
+	MaxObjects int `yaml:"max_objects"`
+	// MaxPreviousAge is the age after which the objects of the last accepted refresh are no longer
+	// compared to, so that a legitimate shrink is eventually accepted (default is 24h)
+	MaxPreviousAge model.Duration `yaml:"max_previous_age"`
+}
+
+// GroupMembership defines the LDAP groups of which the members, including the members of nested
+// groups, are the objects discovered for the target group
+type GroupMembership struct {
+	// Groups is the list of group DNs
+	Groups []string `yaml:"groups"`
+	// Mode is the resolution of nested groups: auto (default), in_chain or recursive.  The
+	// in_chain mode uses the ActiveDirectory LDAP_MATCHING_RULE_IN_CHAIN while the recursive mode
+	// walks the member attribute of each group.  The auto mode uses in_chain on ActiveDirectory.
+	Mode string `yaml:"mode"`
+	// MaxDepth is the maximum depth of the members followed by the recursive mode, the direct members
+	// of the groups being at depth 1 (default is 10)
+	MaxDepth int `yaml:"max_depth"`
+}
+
+// Group membership resolution modes
+const (
+	GroupModeAuto      = "auto"
+	GroupModeInChain   = "in_chain"
+	GroupModeRecursive = "recursive"
+)
+
+// Deduplication defines how duplicated objects or targets of the group are removed
+type Deduplication struct {
+	// Key identifies the duplicates: dn (default), object_guid, address or none
+	Key string `yaml:"key"`
+	// LabelConflicts is the merging of labels with different values: first (default), last or drop
+	LabelConflicts string `yaml:"label_conflicts"`
+}
+
+// Deduplication keys and label conflict policies
+const (
+	DedupKeyDN         = "dn"
+	DedupKeyObjectGUID = "object_guid"
+	DedupKeyAddress    = "address"
+	DedupKeyNone       = "none"
+	ConflictFirst      = "first"
+	ConflictLast       = "last"
+	ConflictDrop       = "drop"
+)
+
+// Partial failure policies, applied when the search of some of the base DNs of a group fails
+const (
+	// PartialFailureServe serves the objects of the successful searches, along with the objects of
+	// the last successful search of each failed base DN
+	PartialFailureServe = "serve_partial"
+	// PartialFailureFail fails the whole target group
+	PartialFailureFail = "fail"
+)
+
+// Exporter probe methods
+const (
+	ProbeMethodTCP  = "tcp"
+	ProbeMethodHTTP = "http"
+)
+
+// Handling of hostnames which fail to resolve
+const (
+	DNSOnFailureLabel = "label"
+	DNSOnFailureDrop  = "drop"
+)
+
+// StaleFilter defines when an account is considered stale and excluded from the targets
+type StaleFilter struct {
+	// MaxAge is the maximum age of the most recent of the Attributes timestamps (ex: 90d)
+	MaxAge model.Duration `yaml:"max_age"`
+	// Attributes are the FILETIME attributes used to determine the last activity of the account
+	Attributes []string `yaml:"attributes"`
+}
+
+// AttributeOptions defines how the values of an LDAP attribute are exposed as labels
+type AttributeOptions struct {
+	// MultiValue is the handling of attributes with multiple values: first, last, join or index
+	MultiValue string `yaml:"multi_value"`
+	// Separator is the separator used to join the values when MultiValue is join
+	Separator string `yaml:"separator"`
+	// Enclose adds the separator at the start and end of the joined values so that a single
+	// value can be matched with a regex such as .*,value,.*
+	Enclose bool `yaml:"enclose"`
+	// DnFormat is the format of the value parsed by DnLabels: dn or canonical.  By default,
+	// canonical is used for the canonicalName attribute and dn for all others.
+	DnFormat string `yaml:"dn_format"`
+	// DnLabels are the labels extracted from the components of a DN or canonical name
+	DnLabels []*DnLabel `yaml:"dn_labels"`
+	// Decode is the decoding applied to the raw values: uac, filetime, guid, sid or none.  By
+	// default, the well known ActiveDirectory attributes are only decoded with decode_ad_attributes.
+	Decode string `yaml:"decode"`
+	// TimeFormat is the format of the decoded filetime values: rfc3339 or epoch
+	TimeFormat string `yaml:"time_format"`
+}
+
+// DnLabel is a label extracted from the components of a DN or canonical name
+type DnLabel struct {
+	// Type is the component to extract: parent_ou, ou_path, ou or domain
+	Type string `yaml:"type"`
+	// Name is the name of the label, without the __meta_ldap_ prefix.  It defaults to
+	// <attribute>_<type>, or <attribute>_ou_<index> for the ou type.
+	Name string `yaml:"name"`
+	// Index is the position of the OU for the ou type, starting at 0 for the top-level OU.
+	// Negative values count from the object, -1 being the immediate parent OU.
+	Index int `yaml:"index"`
+	// Separator is the separator used to join the OUs for the ou_path type (default is /)
+	Separator string `yaml:"separator"`
 }
 
+// LabelName returns the name of the label, without the __meta_ldap_ prefix, extracted from the
+// named attribute
+func (l *DnLabel) LabelName(attrib string) string {
+	if l.Name != "" {
+		return l.Name
+	}
+	if l.Type == DnLabelOu {
+		return fmt.Sprintf("%s_%s_%d", AttributeLabelName(attrib), l.Type, l.Index)
+	}
+	return fmt.Sprintf("%s_%s", AttributeLabelName(attrib), l.Type)
+}
+
+// Multi-valued attribute handling modes
+const (
+	MultiValueFirst = "first"
+	MultiValueLast  = "last"
+	MultiValueJoin  = "join"
+	MultiValueIndex = "index"
+)
+
+// ActiveDirectory attribute decodings and time formats
+const (
+	DecodeNone        = "none"
+	DecodeUAC         = "uac"
+	DecodeFiletime    = "filetime"
+	DecodeGUID        = "guid"
+	DecodeSID         = "sid"
+	TimeFormatRFC3339 = "rfc3339"
+	TimeFormatEpoch   = "epoch"
+	defaultTimeFormat = TimeFormatRFC3339
+)
+
+// wellKnownDecodings are the decodings applied to ActiveDirectory attributes with decode_ad_attributes
+var wellKnownDecodings = map[string]string{
+	"useraccountcontrol": DecodeUAC,
+	"lastlogontimestamp": DecodeFiletime,
+	"lastlogon":          DecodeFiletime,
+	"pwdlastset":         DecodeFiletime,
+	"accountexpires":     DecodeFiletime,
+	"badpasswordtime":    DecodeFiletime,
+	"lockouttime":        DecodeFiletime,
+	"objectguid":         DecodeGUID,
+	"objectsid":          DecodeSID,
+}
+
+// AttributeDecoding returns the decoding applied to the values of the named attribute.  The well
+// known ActiveDirectory attributes are only decoded by default when enabled with
+// decode_ad_attributes, so that their raw values used by existing relabeling rules don't change.
+func (c *LdapConfig) AttributeDecoding(attrib string, opts *AttributeOptions) string {
+	if opts != nil && opts.Decode != "" {
+		return opts.Decode
+	}
+	if decode, ok := wellKnownDecodings[strings.ToLower(attrib)]; ok && c.DecodeADAttributes {
+		return decode
+	}
+	return DecodeNone
+}
+
+// NoLabelValueLengthLimit disables the global max_label_value_length for a target group, where 0
+// inherits the global limit
+const NoLabelValueLengthLimit = -1
+
+// Handling of label values which aren't valid UTF-8
+const (
+	InvalidUTF8Replace = "replace"
+	InvalidUTF8Hex     = "hex"
+	InvalidUTF8Drop    = "drop"
+)
+
+func validateInvalidUTF8Values(value string) error {
+	switch value {
+	case "", InvalidUTF8Replace, InvalidUTF8Hex, InvalidUTF8Drop:
+		return nil
+	}
+	return fmt.Errorf("invalid invalid_utf8_values %q, must be one of replace, hex or drop", value)
+}
+
+// DN formats and label types
+const (
+	DnFormatDn        = "dn"
+	DnFormatCanonical = "canonical"
+	DnLabelParentOu   = "parent_ou"
+	DnLabelOuPath     = "ou_path"
+	DnLabelOu         = "ou"
+	DnLabelDomain     = "domain"
+)
+
+const (
+	defaultExporterPortName = "default"
+	defaultValueSeparator   = ","
+	defaultOuPathSeparator  = "/"
+	defaultDNSTimeout       = 2 * time.Second
+	defaultDNSConcurrency   = 10
+	defaultProbePath        = "/metrics"
+	defaultProbeTimeout     = 2 * time.Second
+	defaultProbeConcurrency = 10
+	defaultGroupMaxDepth    = 10
+	defaultMaxPreviousAge   = 24 * time.Hour
+)
+
 // Validate ensures that the current ldap configuration is valid
 func (c *LdapConfig) Validate() error {
 	if c.URL == "" {
@@ -42,13 +400,54 @@ func (c *LdapConfig) Validate() error {
 	if c.BindDN == "" {
 		return errors.New("ldap_config.bind_dn must be set")
 	}
-	if len(c.BaseDnMappings) == 0 {
+	if err := validateFilter("ldap_config.filter", c.Filter); err != nil {
+		return err
+	}
+	if err := validateLabels("ldap_config.labels", c.Labels); err != nil {
+		return err
+	}
+	if c.MaxLabelValueLength < 0 {
+		return errors.New("ldap_config.max_label_value_length must not be negative")
+	}
+	if c.InvalidUTF8Values == "" {
+		c.InvalidUTF8Values = InvalidUTF8Replace
+	}
+	if err := validateInvalidUTF8Values(c.InvalidUTF8Values); err != nil {
+		return fmt.Errorf("ldap_config: %v", err)
+	}
+	if c.Referrals == nil {
+		c.Referrals = &Referrals{}
+	}
+	if err := c.Referrals.Validate(); err != nil {
+		return err
+	}
+	if len(c.BaseDnMappings) == 0 && len(c.GroupTemplates) == 0 {
 		return errors.New("ldap_config.base_dn_mappings must be set")
-	} else {
-		for k, v := range c.BaseDnMappings {
-			if len(v.BaseDnList) == 0 && v.Filter == "" {
-				return fmt.Errorf("base_dn_list for %s must have at least one base DN or custom filter must be set", k)
-			}
+	}
+	for k, v := range c.BaseDnMappings {
+		if v == nil {
+			return fmt.Errorf("base_dn_mappings.%s must not be empty", k)
+		}
+		c.inheritOptions(v)
+		if err := v.Validate(k); err != nil {
+			return err
+		}
+		if err := c.validateLabelNames(fmt.Sprintf("base_dn_mappings.%s", k), v); err != nil {
+			return err
+		}
+	}
+	for k, v := range c.GroupTemplates {
+		if v == nil {
+			return fmt.Errorf("group_templates.%s must not be empty", k)
+		}
+		if v.Mapping != nil {
+			c.inheritOptions(v.Mapping)
+		}
+		if err := v.Validate(k); err != nil {
+			return err
+		}
+		if err := c.validateLabelNames(fmt.Sprintf("group_templates.%s.mapping", k), v.Mapping); err != nil {
+			return err
 		}
 	}
 
@@ -60,3 +459,378 @@ func (c *LdapConfig) Validate() error {
 	}
 	return nil
 }
+
+// Validate ensures that the configuration of the target group is valid
+func (m *BaseDnMapping) Validate(name string) error {
+	if len(m.BaseDnList) == 0 && m.Filter == "" && m.GroupMembership == nil && m.GlobalCatalog == nil {
+		return fmt.Errorf("base_dn_list for %s must have at least one base DN or custom filter must be set", name)
+	}
+	if m.GlobalCatalog != nil {
+		if m.GroupMembership != nil {
+			return fmt.Errorf("base_dn_mappings.%s.global_catalog can't be combined with group_membership", name)
+		}
+		if err := m.GlobalCatalog.Validate(fmt.Sprintf("base_dn_mappings.%s.global_catalog", name)); err != nil {
+			return err
+		}
+	}
+	if err := validateFilter(fmt.Sprintf("base_dn_mappings.%s.filter", name), m.Filter); err != nil {
+		return err
+	}
+
+	for i, b := range m.BaseDnList {
+		if b == nil {
+			return fmt.Errorf("base_dn_mappings.%s.base_dn_list[%d] must not be empty", name, i)
+		}
+		if err := b.Validate(fmt.Sprintf("base_dn_mappings.%s.base_dn_list[%d]", name, i)); err != nil {
+			return err
+		}
+	}
+
+	if m.Guardrails != nil {
+		if m.Guardrails.MaxShrinkPercent < 0 || m.Guardrails.MaxShrinkPercent > 100 {
+			return fmt.Errorf("base_dn_mappings.%s.guardrails.max_shrink_percent must be between 0 and 100", name)
+		}
+		if m.Guardrails.MaxObjects < 0 {
+			return fmt.Errorf("base_dn_mappings.%s.guardrails.max_objects must not be negative", name)
+		}
+		if m.Guardrails.MaxPreviousAge < 0 {
+			return fmt.Errorf("base_dn_mappings.%s.guardrails.max_previous_age must not be negative", name)
+		}
+		if m.Guardrails.MaxPreviousAge == 0 {
+			m.Guardrails.MaxPreviousAge = model.Duration(defaultMaxPreviousAge)
+		}
+	}
+
+	if m.GroupMembership != nil {
+		if len(m.GroupMembership.Groups) == 0 {
+			return fmt.Errorf("base_dn_mappings.%s.group_membership.groups must have at least one group DN", name)
+		}
+		for i, g := range m.GroupMembership.Groups {
+			if _, err := ldap.ParseDN(g); err != nil || strings.TrimSpace(g) == "" {
+				return fmt.Errorf("base_dn_mappings.%s.group_membership.groups[%d] is not a valid DN: %q", name, i, g)
+			}
+		}
+		switch m.GroupMembership.Mode {
+		case "":
+			m.GroupMembership.Mode = GroupModeAuto
+		case GroupModeAuto, GroupModeInChain, GroupModeRecursive:
+		default:
+			return fmt.Errorf("base_dn_mappings.%s.group_membership.mode must be one of auto, in_chain or recursive", name)
+		}
+		if m.GroupMembership.MaxDepth <= 0 {
+			m.GroupMembership.MaxDepth = defaultGroupMaxDepth
+		}
+	}
+
+	if (m.ExporterPort != 0 || m.ExporterPortAttribute != "") && len(m.ExporterPorts) >= 1 {
+		return fmt.Errorf("base_dn_mappings.%s: exporter_port/exporter_port_attribute can't be combined with exporter_ports", name)
+	}
+	if len(m.ExporterPorts) == 0 {
+		if m.ExporterPort == 0 && m.ExporterPortAttribute == "" {
+			return fmt.Errorf("base_dn_mappings.%s: exporter_port, exporter_port_attribute or exporter_ports must be set", name)
+		}
+		// The single exporter_port is the shorthand for a list holding one port
+		m.ExporterPorts = []*ExporterPort{{
+			Name:          defaultExporterPortName,
+			Port:          m.ExporterPort,
+			PortAttribute: m.ExporterPortAttribute,
+		}}
+		m.ExporterPort = 0
+		m.ExporterPortAttribute = ""
+	}
+
+	portNames := map[string]bool{}
+	for i, p := range m.ExporterPorts {
+		if p == nil {
+			return fmt.Errorf("base_dn_mappings.%s.exporter_ports[%d] must not be empty", name, i)
+		}
+		if strings.TrimSpace(p.Name) == "" {
+			return fmt.Errorf("base_dn_mappings.%s.exporter_ports[%d].name must be set", name, i)
+		}
+		if portNames[p.Name] {
+			return fmt.Errorf("base_dn_mappings.%s.exporter_ports: duplicate port name %q", name, p.Name)
+		}
+		portNames[p.Name] = true
+		// Without a port attribute, the static port is the only source so it must be valid
+		if (p.PortAttribute == "" || p.Port != 0) && (p.Port < 1 || p.Port > 65535) {
+			return fmt.Errorf("base_dn_mappings.%s.exporter_ports[%d].port must be between 1 and 65535", name, i)
+		}
+	}
+
+	if err := validateLabels(fmt.Sprintf("base_dn_mappings.%s.labels", name), m.Labels); err != nil {
+		return err
+	}
+
+	for i, rc := range m.RelabelConfigs {
+		if rc == nil {
+			return fmt.Errorf("base_dn_mappings.%s.relabel_configs[%d] must not be empty", name, i)
+		}
+		if err := rc.Validate(model.LegacyValidation); err != nil {
+			return fmt.Errorf("base_dn_mappings.%s.relabel_configs[%d]: %v", name, i, err)
+		}
+	}
+
+	if m.MaxLabelValueLength < NoLabelValueLengthLimit {
+		return fmt.Errorf("base_dn_mappings.%s.max_label_value_length must be positive, 0 to use the global limit or -1 for no limit", name)
+	}
+	if m.InvalidUTF8Values == "" {
+		m.InvalidUTF8Values = InvalidUTF8Replace
+	}
+	if err := validateInvalidUTF8Values(m.InvalidUTF8Values); err != nil {
+		return fmt.Errorf("base_dn_mappings.%s: %v", name, err)
+	}
+
+	if m.ExcludeStale != nil {
+		if m.ExcludeStale.MaxAge <= 0 {
+			return fmt.Errorf("base_dn_mappings.%s.exclude_stale.max_age must be greater than 0", name)
+		}
+		if len(m.ExcludeStale.Attributes) == 0 {
+			m.ExcludeStale.Attributes = []string{"lastLogonTimestamp", "pwdLastSet"}
+		}
+	}
+
+	if m.DNSResolution != nil {
+		switch m.DNSResolution.OnFailure {
+		case "":
+			m.DNSResolution.OnFailure = DNSOnFailureLabel
+		case DNSOnFailureLabel, DNSOnFailureDrop:
+		default:
+			return fmt.Errorf("base_dn_mappings.%s.dns_resolution.on_failure must be one of label or drop", name)
+		}
+		if m.DNSResolution.Timeout <= 0 {
+			m.DNSResolution.Timeout = model.Duration(defaultDNSTimeout)
+		}
+		if m.DNSResolution.Concurrency <= 0 {
+			m.DNSResolution.Concurrency = defaultDNSConcurrency
+		}
+	}
+
+	if m.ExporterProbe != nil {
+		switch m.ExporterProbe.Method {
+		case "":
+			m.ExporterProbe.Method = ProbeMethodTCP
+		case ProbeMethodTCP, ProbeMethodHTTP:
+		default:
+			return fmt.Errorf("base_dn_mappings.%s.exporter_probe.method must be one of tcp or http", name)
+		}
+		if m.ExporterProbe.Path == "" {
+			m.ExporterProbe.Path = defaultProbePath
+		}
+		if !strings.HasPrefix(m.ExporterProbe.Path, "/") {
+			return fmt.Errorf("base_dn_mappings.%s.exporter_probe.path must start with /", name)
+		}
+		if m.ExporterProbe.Timeout <= 0 {
+			m.ExporterProbe.Timeout = model.Duration(defaultProbeTimeout)
+		}
+		if m.ExporterProbe.Concurrency <= 0 {
+			m.ExporterProbe.Concurrency = defaultProbeConcurrency
+		}
+	}
+
+	if m.Deduplicate == nil {
+		m.Deduplicate = &Deduplication{}
+	}
+	switch m.Deduplicate.Key {
+	case "":
+		m.Deduplicate.Key = DedupKeyDN
+	case DedupKeyDN, DedupKeyObjectGUID, DedupKeyAddress, DedupKeyNone:
+	default:
+		return fmt.Errorf("base_dn_mappings.%s.deduplicate.key must be one of dn, object_guid, address or none", name)
+	}
+	switch m.Deduplicate.LabelConflicts {
+	case "":
+		m.Deduplicate.LabelConflicts = ConflictFirst
+	case ConflictFirst, ConflictLast, ConflictDrop:
+	default:
+		return fmt.Errorf("base_dn_mappings.%s.deduplicate.label_conflicts must be one of first, last or drop", name)
+	}
+
+	switch m.OnPartialFailure {
+	case "":
+		m.OnPartialFailure = PartialFailureServe
+	case PartialFailureServe, PartialFailureFail:
+	default:
+		return fmt.Errorf("base_dn_mappings.%s.on_partial_failure must be one of serve_partial or fail", name)
+	}
+
+	for attrib, opts := range m.AttributeOptions {
+		if opts == nil {
+			return fmt.Errorf("base_dn_mappings.%s.attribute_options.%s must not be empty", name, attrib)
+		}
+		if err := opts.Validate(attrib); err != nil {
+			return fmt.Errorf("base_dn_mappings.%s.attribute_options.%s: %v", name, attrib, err)
+		}
+	}
+
+	if m.AddressTemplate != "" && len(m.HostnameSources) >= 1 {
+		return fmt.Errorf("base_dn_mappings.%s: address_template can't be combined with hostname_sources", name)
+	}
+	if m.AddressTemplate == "" && len(m.HostnameSources) == 0 {
+		m.HostnameSources = []*HostnameSource{{Attribute: "dNSHostName"}}
+	}
+	for i, h := range m.HostnameSources {
+		if h == nil || strings.TrimSpace(h.Attribute) == "" {
+			return fmt.Errorf("base_dn_mappings.%s.hostname_sources[%d].attribute must be set", name, i)
+		}
+	}
+
+	if m.AddressTemplate != "" {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(m.AddressTemplate)
+		if err != nil {
+			return fmt.Errorf("base_dn_mappings.%s.address_template is invalid: %v", name, err)
+		}
+		m.addressTemplate = tmpl
+	}
+
+	return nil
+}
+
+// Validate ensures the attribute options are valid and sets their default values
+func (o *AttributeOptions) Validate(attrib string) error {
+	switch o.MultiValue {
+	case "":
+		o.MultiValue = MultiValueFirst
+	case MultiValueFirst, MultiValueLast, MultiValueJoin, MultiValueIndex:
+	default:
+		return fmt.Errorf("invalid multi_value %q, must be one of first, last, join or index", o.MultiValue)
+	}
+	if o.Separator == "" {
+		o.Separator = defaultValueSeparator
+	}
+
+	switch o.Decode {
+	case "", DecodeNone, DecodeUAC, DecodeFiletime, DecodeGUID, DecodeSID:
+	default:
+		return fmt.Errorf("invalid decode %q, must be one of uac, filetime, guid, sid or none", o.Decode)
+	}
+	switch o.TimeFormat {
+	case "":
+		o.TimeFormat = defaultTimeFormat
+	case TimeFormatRFC3339, TimeFormatEpoch:
+	default:
+		return fmt.Errorf("invalid time_format %q, must be one of rfc3339 or epoch", o.TimeFormat)
+	}
+
+	switch o.DnFormat {
+	case "":
+		o.DnFormat = DnFormatDn
+		if strings.EqualFold(attrib, "canonicalName") {
+			o.DnFormat = DnFormatCanonical
+		}
+	case DnFormatDn, DnFormatCanonical:
+	default:
+		return fmt.Errorf("invalid dn_format %q, must be one of dn or canonical", o.DnFormat)
+	}
+
+	for i, l := range o.DnLabels {
+		if l == nil {
+			return fmt.Errorf("dn_labels[%d] must not be empty", i)
+		}
+		switch l.Type {
+		case DnLabelParentOu, DnLabelOuPath, DnLabelOu, DnLabelDomain:
+		default:
+			return fmt.Errorf("dn_labels[%d]: invalid type %q, must be one of parent_ou, ou_path, ou or domain", i, l.Type)
+		}
+		if l.Type == DnLabelOu && l.Index < 0 && l.Name == "" {
+			return fmt.Errorf("dn_labels[%d]: name must be set when using a negative index", i)
+		}
+		if l.Name != "" && !labelNameRE.MatchString(l.Name) {
+			return fmt.Errorf("dn_labels[%d]: %q is not a valid label name", i, l.Name)
+		}
+		if l.Separator == "" {
+			l.Separator = defaultOuPathSeparator
+		}
+	}
+	return nil
+}
+
+// RenderAddress builds the target address from the attributes of an LDAP object using the
+// address_template of the target group.  An empty string is returned when no template is set.
+// Attributes without a value are left out so that a template referencing one of them fails
+// instead of rendering a partial address.
+func (m *BaseDnMapping) RenderAddress(attributes map[string]string) (string, error) {
+	if m.addressTemplate == nil {
+		return "", nil
+	}
+	values := make(map[string]string, len(attributes))
+	for k, v := range attributes {
+		if strings.TrimSpace(v) != "" {
+			values[k] = v
+		}
+	}
+	var b strings.Builder
+	if err := m.addressTemplate.Execute(&b, values); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// RequiredAttributes returns the LDAP attributes which must be fetched to build the targets
+// of the group, such as port attributes and the fields referenced in the address template.
+func (m *BaseDnMapping) RequiredAttributes() []string {
+	attributes := []string{}
+	for _, p := range m.ExporterPorts {
+		if p.PortAttribute != "" {
+			attributes = append(attributes, p.PortAttribute)
+		}
+	}
+	if m.addressTemplate != nil {
+		attributes = append(attributes, templateFields(m.addressTemplate.Tree.Root)...)
+	}
+	for _, h := range m.HostnameSources {
+		attributes = append(attributes, h.Attribute)
+	}
+	if m.Deduplicate != nil && m.Deduplicate.Key == DedupKeyObjectGUID {
+		attributes = append(attributes, "objectGUID")
+	}
+	if m.ExcludeDisabled {
+		attributes = append(attributes, "userAccountControl")
+	}
+	if m.ExcludeStale != nil {
+		attributes = append(attributes, m.ExcludeStale.Attributes...)
+	}
+	for attrib, opts := range m.AttributeOptions {
+		if len(opts.DnLabels) >= 1 {
+			attributes = append(attributes, attrib)
+		}
+	}
+	return attributes
+}
+
+// templateFields collects the names of the fields referenced within a template node
+func templateFields(node parse.Node) []string {
+	fields := []string{}
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return fields
+		}
+		for _, child := range n.Nodes {
+			fields = append(fields, templateFields(child)...)
+		}
+	case *parse.ActionNode:
+		fields = append(fields, templateFields(n.Pipe)...)
+	case *parse.PipeNode:
+		if n == nil {
+			return fields
+		}
+		for _, cmd := range n.Cmds {
+			for _, arg := range cmd.Args {
+				fields = append(fields, templateFields(arg)...)
+			}
+		}
+	case *parse.FieldNode:
+		if len(n.Ident) >= 1 {
+			fields = append(fields, n.Ident[0])
+		}
+	case *parse.IfNode:
+		fields = append(fields, templateFields(n.Pipe)...)
+		fields = append(fields, templateFields(n.List)...)
+		fields = append(fields, templateFields(n.ElseList)...)
+	case *parse.WithNode:
+		fields = append(fields, templateFields(n.Pipe)...)
+		fields = append(fields, templateFields(n.List)...)
+		fields = append(fields, templateFields(n.ElseList)...)
+	}
+	return fields
+}
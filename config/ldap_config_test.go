@@ -0,0 +1,658 @@
+package config
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+func TestBaseDnMappingExporterPorts(t *testing.T) {
+
+	m := &BaseDnMapping{BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: 9182}
+	if err := m.Validate("servers"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(m.ExporterPorts) != 1 || m.ExporterPorts[0].Port != 9182 || m.ExporterPorts[0].Name != defaultExporterPortName {
+		t.Errorf("Expecting exporter_port to be converted to a single default port, got %+v", m.ExporterPorts)
+	}
+	// Validation must be repeatable on an already validated mapping
+	if err := m.Validate("servers"); err != nil {
+		t.Errorf("Unexpected error on second validation: %s", err)
+	}
+
+	m = &BaseDnMapping{
+		BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+		ExporterPorts: []*ExporterPort{
+			{Name: "windows", Port: 9182},
+			{Name: "app", Port: 9500},
+		},
+	}
+	if err := m.Validate("servers"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	invalid := []*BaseDnMapping{
+		{BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}},
+		{BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPorts: []*ExporterPort{{Name: "windows"}}},
+		{BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPorts: []*ExporterPort{{Name: "windows", Port: 70000}}},
+		{BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPorts: []*ExporterPort{{Port: 9182}}},
+		{BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPorts: []*ExporterPort{{Name: "a", Port: 1}, {Name: "a", Port: 2}}},
+		{BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: 9182, ExporterPorts: []*ExporterPort{{Name: "a", Port: 1}}},
+	}
+	for i, m := range invalid {
+		if err := m.Validate("servers"); err == nil {
+			t.Errorf("Expecting validation error for mapping %d", i)
+		}
+	}
+}
+
+func TestBaseDnMappingAddressTemplate(t *testing.T) {
+
+	m := &BaseDnMapping{
+		BaseDnList:            []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+		ExporterPortAttribute: "extensionAttribute1",
+		AddressTemplate:       "{{ .name }}.corp.example.org",
+	}
+	if err := m.Validate("servers"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if m.ExporterPorts[0].PortAttribute != "extensionAttribute1" || m.ExporterPorts[0].Port != 0 {
+		t.Errorf("Expecting port attribute without fallback port, got %+v", m.ExporterPorts[0])
+	}
+
+	address, err := m.RenderAddress(map[string]string{"name": "host01"})
+	if err != nil || address != "host01.corp.example.org" {
+		t.Errorf("Expecting address %q, got %q (error: %v)", "host01.corp.example.org", address, err)
+	}
+
+	for _, attributes := range []map[string]string{{}, {"name": ""}} {
+		if address, err := m.RenderAddress(attributes); err == nil {
+			t.Errorf("Expecting error for missing template field, got address %q", address)
+		}
+	}
+
+	required := m.RequiredAttributes()
+	if len(required) != 2 || required[0] != "extensionAttribute1" || required[1] != "name" {
+		t.Errorf("Unexpected required attributes: %v", required)
+	}
+
+	m = &BaseDnMapping{
+		BaseDnList:      []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+		ExporterPort:    9182,
+		AddressTemplate: "{{ .name ",
+	}
+	if err := m.Validate("servers"); err == nil {
+		t.Errorf("Expecting validation error for invalid address template")
+	}
+}
+
+func TestMaxLabelValueLength(t *testing.T) {
+
+	c := &LdapConfig{
+		URL:                 "ldap.example.org:389",
+		BindDN:              "CN=ro_user,DC=example,DC=org",
+		DefaultAttributes:   []string{"operatingSystem"},
+		MaxLabelValueLength: 64,
+		BaseDnMappings: map[string]*BaseDnMapping{
+			"servers":  {BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: 9182},
+			"desktops": {BaseDnList: []*BaseDn{{DN: "OU=Desktops,DC=example,DC=org"}}, ExporterPort: 9182, MaxLabelValueLength: NoLabelValueLengthLimit},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Invalid configuration: %s", err)
+	}
+	if l := c.BaseDnMappings["servers"].MaxLabelValueLength; l != 64 {
+		t.Errorf("Expecting the global limit to be inherited, got %d", l)
+	}
+	if l := c.BaseDnMappings["desktops"].MaxLabelValueLength; l != NoLabelValueLengthLimit {
+		t.Errorf("Expecting no limit, got %d", l)
+	}
+
+	c.BaseDnMappings["desktops"].MaxLabelValueLength = -2
+	if err := c.Validate(); err == nil {
+		t.Errorf("Expecting validation error for max_label_value_length -2")
+	}
+}
+
+func TestLabelsValidation(t *testing.T) {
+
+	if err := validateLabels("labels", map[string]string{"env": "prod", "__scheme__": "https", "team_1": "x"}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	for _, name := range []string{"", "1env", "team-name", "env.name"} {
+		if err := validateLabels("labels", map[string]string{name: "x"}); err == nil {
+			t.Errorf("Expecting validation error for label name %q", name)
+		}
+	}
+}
+
+func TestReferralsValidation(t *testing.T) {
+
+	c := &LdapConfig{
+		URL:               "ldap.example.org:389",
+		BindDN:            "CN=ro_user,DC=example,DC=org",
+		DefaultAttributes: []string{"operatingSystem"},
+		BaseDnMappings:    map[string]*BaseDnMapping{"servers": {BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: 9182}},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if c.Referrals.Follow || c.Referrals.MaxHops != defaultReferralMaxHops {
+		t.Errorf("Expecting referrals not followed with the default max hops, got %+v", c.Referrals)
+	}
+
+	c.Referrals = &Referrals{Follow: true, MaxHops: -1, AllowedHosts: []string{".example.org"}}
+	if err := c.Validate(); err == nil {
+		t.Errorf("Expecting validation error for negative max hops")
+	}
+
+	c.Referrals = &Referrals{Follow: true}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "allowed_hosts must be set") {
+		t.Errorf("Expecting validation error for followed referrals without allowed hosts, got %v", err)
+	}
+
+	c.Referrals = &Referrals{Follow: true, AllowedHosts: []string{"ldap://child.example.org"}}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "allowed_hosts[0]") {
+		t.Errorf("Expecting validation error for an allowed host with a scheme, got %v", err)
+	}
+
+	r := &Referrals{Follow: true, AllowedHosts: []string{".child.example.org", "dc1.example.org"}}
+	if err := r.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for host, expected := range map[string][2]bool{
+		"DC1.example.org":        {true, true},
+		"dc2.child.example.org":  {true, false},
+		"child.example.org":      {false, false},
+		"dc2.example.org":        {false, false},
+		"dc1.example.org.attack": {false, false},
+	} {
+		if r.AllowsHost(host) != expected[0] || r.ListsHost(host) != expected[1] {
+			t.Errorf("Expecting allowed %t and listed %t for %s", expected[0], expected[1], host)
+		}
+	}
+}
+
+func TestGlobalCatalog(t *testing.T) {
+
+	c := &LdapConfig{
+		URL:               "ldap.example.org:636",
+		BindDN:            "CN=ro_user,DC=example,DC=org",
+		DefaultAttributes: []string{"operatingSystem"},
+		BaseDnMappings: map[string]*BaseDnMapping{"forest": {
+			GlobalCatalog: &GlobalCatalog{ReplicatedAttributes: []string{"location"}},
+			ExporterPort:  9182,
+			Attributes:    []string{"Location", "lastLogonTimestamp", "operatingSystemVersion"},
+			ExcludeStale:  &StaleFilter{MaxAge: model.Duration(24 * time.Hour)},
+		}},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	m := c.BaseDnMappings["forest"]
+	if m.GlobalCatalog.Server != "ldap.example.org:3269" || m.GlobalCatalog.URL() != "ldaps://ldap.example.org:3269" {
+		t.Errorf("Unexpected Global Catalog server %s (%s)", m.GlobalCatalog.Server, m.GlobalCatalog.URL())
+	}
+	expected := []string{"lastLogonTimestamp", "pwdLastSet"}
+	if attributes := c.NonReplicatedAttributes(m); !reflect.DeepEqual(attributes, expected) {
+		t.Errorf("Expecting non replicated attributes %v, got %v", expected, attributes)
+	}
+
+	c.URL = "ldap.example.org:389"
+	m.GlobalCatalog.Server = ""
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if m.GlobalCatalog.URL() != "ldap://ldap.example.org:3268" {
+		t.Errorf("Unexpected Global Catalog URL %s", m.GlobalCatalog.URL())
+	}
+
+	m.GroupMembership = &GroupMembership{Groups: []string{"CN=Monitored,DC=example,DC=org"}}
+	if err := c.Validate(); err == nil {
+		t.Errorf("Expecting validation error for global_catalog with group_membership")
+	}
+}
+
+func TestChangedGroups(t *testing.T) {
+
+	newConfig := func() *LdapConfig {
+		c := &LdapConfig{
+			URL:               "ldap.example.org:389",
+			BindDN:            "CN=ro_user,DC=example,DC=org",
+			DefaultAttributes: []string{"operatingSystem"},
+			BaseDnMappings: map[string]*BaseDnMapping{
+				"servers":  {BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: 9182},
+				"desktops": {BaseDnList: []*BaseDn{{DN: "OU=Desktops,DC=example,DC=org"}}, ExporterPort: 9182},
+				"laptops":  {BaseDnList: []*BaseDn{{DN: "OU=Laptops,DC=example,DC=org"}}, ExporterPort: 9182},
+			},
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("Invalid configuration: %s", err)
+		}
+		return c
+	}
+
+	c, o := newConfig(), newConfig()
+	if changed := c.ChangedGroups(o); len(changed) != 0 || c.ConnectionChanged(o) {
+		t.Errorf("Expecting no changes, got %v", changed)
+	}
+
+	o.BaseDnMappings["desktops"].ExporterPort = 9100
+	delete(o.BaseDnMappings, "laptops")
+	o.CacheTTL = 600
+	if changed := c.ChangedGroups(o); !reflect.DeepEqual(changed, []string{"desktops", "laptops"}) {
+		t.Errorf("Expecting the desktops and laptops groups to be changed, got %v", changed)
+	}
+
+	o.Filter = "(objectClass=computer)"
+	if changed := c.ChangedGroups(o); !reflect.DeepEqual(changed, []string{"desktops", "laptops", "servers"}) {
+		t.Errorf("Expecting all the groups to be changed, got %v", changed)
+	}
+
+	o.BindDN = "CN=other,DC=example,DC=org"
+	if !c.ConnectionChanged(o) {
+		t.Errorf("Expecting the connection settings to be changed")
+	}
+}
+
+func TestAttributeLabelName(t *testing.T) {
+
+	tests := map[string]string{
+		"operatingSystem":               "operating_system",
+		"dNSHostName":                   "d_ns_host_name",
+		"msDS-SupportedEncryptionTypes": "ms_ds_supported_encryption_types",
+		"extensionAttribute1":           "extension_attribute1",
+		"ms-Mcs-AdmPwdExpirationTime":   "ms_mcs_adm_pwd_expiration_time",
+		"1.2.840.113556.1.4.8":          "1_2_840_113556_1_4_8",
+	}
+	for attrib, expected := range tests {
+		if res := AttributeLabelName(attrib); res != expected {
+			t.Errorf("Expecting label name %q for attribute %q, got %q", expected, attrib, res)
+		}
+	}
+
+	if err := validateAttributeLabelNames("attributes", []string{"msDS-Foo", "operatingSystem", "operatingSystem"}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := validateAttributeLabelNames("attributes", []string{"msDS-Foo", "msDS_Foo"}); err == nil {
+		t.Errorf("Expecting error for colliding label names")
+	}
+
+	c := &LdapConfig{
+		DefaultAttributes:  []string{"operatingSystem", "userAccountControl"},
+		Labels:             map[string]string{"env": "prod"},
+		DecodeADAttributes: true,
+	}
+	m := &BaseDnMapping{Labels: map[string]string{"env": "test"}}
+	if err := c.validateLabelNames("base_dn_mappings.servers", m); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	collisions := []*BaseDnMapping{
+		{Labels: map[string]string{"__meta_ldap_user_account_control_disabled": "false"}},
+		{AttributeOptions: map[string]*AttributeOptions{"distinguishedName": {DnLabels: []*DnLabel{{Type: DnLabelParentOu, Name: "operating_system"}}}}},
+		{Attributes: []string{"userAccountControlFlags"}},
+		{Attributes: []string{"exporterReachable"}},
+		{Attributes: []string{"hostname"}},
+		{Labels: map[string]string{"__meta_ldap_dns_resolved": "true"}},
+		{AttributeOptions: map[string]*AttributeOptions{"distinguishedName": {DnLabels: []*DnLabel{{Type: DnLabelParentOu, Name: "exporter_port_name"}}}}},
+	}
+	for _, m := range collisions {
+		if err := c.validateLabelNames("base_dn_mappings.servers", m); err == nil {
+			t.Errorf("Expecting error for colliding label names of %+v", m)
+		}
+	}
+	err := c.validateLabelNames("base_dn_mappings.servers", collisions[4])
+	if err == nil || err.Error() != `base_dn_mappings.servers: built-in label and attribute "hostname" would both be exposed as label __meta_ldap_hostname` {
+		t.Errorf("Unexpected error for the attribute colliding with a built-in label: %v", err)
+	}
+	// The userAccountControl flags labels are only added when it's decoded
+	c.DecodeADAttributes = false
+	if err := c.validateLabelNames("base_dn_mappings.servers", collisions[2]); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestBaseDnMappingGroupMembership(t *testing.T) {
+
+	m := &BaseDnMapping{
+		ExporterPort:    9182,
+		GroupMembership: &GroupMembership{Groups: []string{"CN=Monitored,OU=Groups,DC=example,DC=org"}},
+	}
+	if err := m.Validate("servers"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if m.GroupMembership.Mode != GroupModeAuto || m.GroupMembership.MaxDepth != defaultGroupMaxDepth {
+		t.Errorf("Expecting default mode and max depth, got %+v", m.GroupMembership)
+	}
+
+	invalid := []*GroupMembership{
+		{},
+		{Groups: []string{"not a DN"}},
+		{Groups: []string{"CN=Monitored,DC=example,DC=org"}, Mode: "nested"},
+	}
+	for i, g := range invalid {
+		m := &BaseDnMapping{ExporterPort: 9182, GroupMembership: g}
+		if err := m.Validate("servers"); err == nil {
+			t.Errorf("Expecting validation error for group membership %d", i)
+		}
+	}
+}
+
+func TestBaseDnMappingGuardrails(t *testing.T) {
+
+	valid := []*Guardrails{
+		{},
+		{MaxShrinkPercent: 30, MaxObjects: 5000},
+		{MaxShrinkPercent: 100, MaxPreviousAge: model.Duration(time.Hour)},
+	}
+	for i, g := range valid {
+		m := &BaseDnMapping{BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: 9182, Guardrails: g}
+		if err := m.Validate("servers"); err != nil {
+			t.Errorf("Unexpected error for guardrails %d: %s", i, err)
+		}
+	}
+	if valid[0].MaxPreviousAge != model.Duration(24*time.Hour) || valid[2].MaxPreviousAge != model.Duration(time.Hour) {
+		t.Errorf("Unexpected max previous ages %s and %s", valid[0].MaxPreviousAge, valid[2].MaxPreviousAge)
+	}
+
+	invalid := []*Guardrails{
+		{MaxShrinkPercent: -1},
+		{MaxShrinkPercent: 101},
+		{MaxObjects: -1},
+		{MaxPreviousAge: -1},
+	}
+	for i, g := range invalid {
+		m := &BaseDnMapping{BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: 9182, Guardrails: g}
+		if err := m.Validate("servers"); err == nil {
+			t.Errorf("Expecting validation error for guardrails %d", i)
+		}
+	}
+}
+
+func TestBaseDnMappingOnPartialFailure(t *testing.T) {
+
+	m := &BaseDnMapping{BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: 9182}
+	if err := m.Validate("servers"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if m.OnPartialFailure != PartialFailureServe {
+		t.Errorf("Expecting default policy %q, got %q", PartialFailureServe, m.OnPartialFailure)
+	}
+
+	m = &BaseDnMapping{BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: 9182, OnPartialFailure: "ignore"}
+	if err := m.Validate("servers"); err == nil {
+		t.Errorf("Expecting validation error for policy %q", m.OnPartialFailure)
+	}
+}
+
+func TestGroupTemplate(t *testing.T) {
+
+	tmpl := &GroupTemplate{
+		Name:      "site-{{ .value }}",
+		Attribute: "location",
+		Mapping:   &BaseDnMapping{BaseDnList: []*BaseDn{{DN: "DC=example,DC=org"}}, Filter: "objectClass=computer", ExporterPort: 9182},
+	}
+	if err := tmpl.Validate("sites"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if tmpl.RefreshInterval != defaultGroupTemplateRefreshInterval || len(tmpl.Mapping.ExporterPorts) != 1 {
+		t.Errorf("Expecting default values to be set, got %+v", tmpl)
+	}
+	name, err := tmpl.RenderName("Montreal (QC)", "")
+	if err != nil || name != "site-Montreal (QC)" {
+		t.Errorf("Unexpected group name %q (error: %v)", name, err)
+	}
+	m, err := tmpl.Generate("Montreal (QC)", "")
+	if err != nil || m.Filter != `(&(objectClass=computer)(location=Montreal \28QC\29))` {
+		t.Errorf("Unexpected generated filter %q", m.Filter)
+	}
+	if tmpl.Mapping.Filter != "objectClass=computer" {
+		t.Errorf("Expecting the template mapping to be unchanged, got filter %q", tmpl.Mapping.Filter)
+	}
+
+	// The value filter also restricts the base DNs which override the filter of the mapping
+	tmpl = &GroupTemplate{
+		Name:      "site-{{ .value }}",
+		Attribute: "location",
+		Mapping: &BaseDnMapping{BaseDnList: []*BaseDn{
+			{DN: "OU=Servers,DC=example,DC=org"},
+			{DN: "OU=Desktops,DC=example,DC=org", Filter: "(operatingSystem=Windows*)"},
+		}, ExporterPort: 9182},
+	}
+	if err := tmpl.Validate("sites"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	m, err = tmpl.Generate("Montreal", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for i, expected := range []string{"(location=Montreal)", "(&(operatingSystem=Windows*)(location=Montreal))"} {
+		f, err := (&LdapConfig{}).EffectiveFilter(m, m.BaseDnList[i])
+		if err != nil || f.String() != expected {
+			t.Errorf("Expecting the effective filter %s for %s, got %v (error: %v)", expected, m.BaseDnList[i].DN, f, err)
+		}
+	}
+	if tmpl.Mapping.BaseDnList[1].Filter != "(operatingSystem=Windows*)" {
+		t.Errorf("Expecting the template base DNs to be unchanged, got filter %q", tmpl.Mapping.BaseDnList[1].Filter)
+	}
+
+	tmpl = &GroupTemplate{
+		Name:       "{{ .ou }}",
+		ChildOUsOf: "OU=Sites,DC=example,DC=org",
+		Mapping:    &BaseDnMapping{ExporterPort: 9182},
+	}
+	if err := tmpl.Validate("sites"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	name, _ = tmpl.RenderName("", "OU=Montreal,OU=Sites,DC=example,DC=org")
+	m, err = tmpl.Generate("", "OU=Montreal,OU=Sites,DC=example,DC=org")
+	if err != nil || name != "Montreal" || len(m.BaseDnList) != 1 || m.BaseDnList[0].DN != "OU=Montreal,OU=Sites,DC=example,DC=org" {
+		t.Errorf("Unexpected generated group %q: %+v", name, m)
+	}
+	if len(tmpl.Mapping.BaseDnList) != 0 {
+		t.Errorf("Expecting the template mapping to be unchanged, got %v", tmpl.Mapping.BaseDnList)
+	}
+
+	invalid := []*GroupTemplate{
+		{Attribute: "location", Mapping: &BaseDnMapping{BaseDnList: []*BaseDn{{DN: "DC=example,DC=org"}}, ExporterPort: 9182}},
+		{Name: "{{ .value", Attribute: "location", Mapping: &BaseDnMapping{BaseDnList: []*BaseDn{{DN: "DC=example,DC=org"}}, ExporterPort: 9182}},
+		{Name: "x", Mapping: &BaseDnMapping{ExporterPort: 9182}},
+		{Name: "x", Attribute: "location", ChildOUsOf: "DC=example,DC=org", Mapping: &BaseDnMapping{ExporterPort: 9182}},
+		{Name: "x", Attribute: "location", Mapping: &BaseDnMapping{ExporterPort: 9182}},
+		{Name: "x", ChildOUsOf: "DC=example,DC=org"},
+		{Name: "x", ChildOUsOf: "DC=example,DC=org", Mapping: &BaseDnMapping{}},
+	}
+	for i, tmpl := range invalid {
+		if err := tmpl.Validate("sites"); err == nil {
+			t.Errorf("Expecting validation error for group template %d", i)
+		}
+	}
+}
+
+func TestBaseDnList(t *testing.T) {
+
+	var m BaseDnMapping
+	err := yaml.Unmarshal([]byte(`
+base_dn_list:
+- "OU=Servers,DC=example,DC=org"
+- dn: "OU=Desktops,DC=example,DC=org"
+  scope: one
+  deref_aliases: always
+  filter: "(operatingSystem=Windows*)"
+exporter_port: 9182
+`), &m)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.Validate("test"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []*BaseDn{
+		{DN: "OU=Servers,DC=example,DC=org", Scope: ScopeSub, DerefAliases: DerefNever},
+		{DN: "OU=Desktops,DC=example,DC=org", Scope: ScopeOne, DerefAliases: DerefAlways, Filter: "(operatingSystem=Windows*)"},
+	}
+	if !reflect.DeepEqual(m.BaseDnList, expected) {
+		t.Errorf("Expecting base DN list %+v, got %+v", expected, m.BaseDnList)
+	}
+	if m.BaseDnList[1].SearchScope() != ldap.ScopeSingleLevel || m.BaseDnList[1].DerefPolicy() != ldap.DerefAlways {
+		t.Errorf("Unexpected search scope or deref policy for %+v", m.BaseDnList[1])
+	}
+
+	// Base DNs with default options are written back as plain strings
+	out, err := yaml.Marshal(m.BaseDnList)
+	if err != nil || !strings.HasPrefix(string(out), "- OU=Servers,DC=example,DC=org\n- dn: OU=Desktops") {
+		t.Errorf("Unexpected serialized base DN list %q (error: %v)", out, err)
+	}
+
+	contains := map[string][]bool{
+		// base DN, direct child, grand child, other
+		ScopeBase: {true, false, false, false},
+		ScopeOne:  {false, true, false, false},
+		ScopeSub:  {true, true, true, false},
+	}
+	dns := []string{
+		"ou=servers,dc=example,dc=org",
+		"CN=host01,OU=Servers,DC=example,DC=org",
+		"CN=host01,OU=Web,OU=Servers,DC=example,DC=org",
+		"CN=host01,OU=Desktops,DC=example,DC=org",
+	}
+	for scope, expected := range contains {
+		b := &BaseDn{DN: "OU=Servers,DC=example,DC=org", Scope: scope}
+		for i, dn := range dns {
+			if res := b.Contains(dn); res != expected[i] {
+				t.Errorf("Expecting Contains(%q) to be %t for scope %s", dn, expected[i], scope)
+			}
+		}
+	}
+
+	invalid := []*BaseDn{
+		{},
+		{DN: "not a DN"},
+		{DN: "OU=Servers,DC=example,DC=org", Scope: "subtree"},
+		{DN: "OU=Servers,DC=example,DC=org", DerefAliases: "sometimes"},
+	}
+	for i, b := range invalid {
+		m := &BaseDnMapping{BaseDnList: []*BaseDn{b}, ExporterPort: 9182}
+		if err := m.Validate("test"); err == nil {
+			t.Errorf("Expecting validation error for base DN %d", i)
+		}
+	}
+}
+
+func TestEffectiveFilter(t *testing.T) {
+
+	c := &LdapConfig{}
+	m := &BaseDnMapping{BaseDnList: []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: 9182}
+	if f, _ := c.EffectiveFilter(m, nil); f.String() != DefaultFilter {
+		t.Errorf("Expecting default filter, got %q", f)
+	}
+
+	c.Filter = "(&(objectClass=computer))"
+	m.Filter = "(&(objectClass=computer)(operatingSystem=Windows*))"
+	if f, _ := c.EffectiveFilter(m, m.BaseDnList[0]); f.String() != "(&(objectClass=computer)(operatingSystem=Windows*))" {
+		t.Errorf("Unexpected combined filter %q", f)
+	}
+
+	b := &BaseDn{DN: "OU=Desktops,DC=example,DC=org", Filter: "operatingSystem=Windows 1*"}
+	if f, _ := c.EffectiveFilter(m, b); f.String() != "(&(objectClass=computer)(operatingSystem=Windows 1*))" {
+		t.Errorf("Expecting base DN filter to override the group filter, got %q", f)
+	}
+
+	c.Filter = "(&(objectClass=computer)"
+	if _, err := c.EffectiveFilter(m, nil); err == nil {
+		t.Errorf("Expecting an invalid global filter to return an error")
+	}
+
+	c.Filter = ""
+	m.Filter = "(&(objectClass=computer)(operatingSystem=Windows*)"
+	if _, err := c.EffectiveFilter(m, nil); err == nil {
+		t.Errorf("Expecting an invalid group filter to return an error")
+	}
+	err := m.Validate("servers")
+	if err == nil || !strings.Contains(err.Error(), "base_dn_mappings.servers.filter") || !strings.Contains(err.Error(), "position 51") {
+		t.Errorf("Expecting filter error with its position, got %v", err)
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+
+	c := &Config{LdapConfig: &LdapConfig{
+		URL:               "ldap.example.org:389",
+		BindDN:            "CN=ro_user,DC=example,DC=org",
+		DefaultAttributes: []string{"operatingSystem"},
+		CacheDir:          "cache",
+		BaseDnMappings: map[string]*BaseDnMapping{
+			"servers": {
+				BaseDnList:   []*BaseDn{{DN: "OU=Servers,DC=example,DC=org"}, {DN: "OU=Appliances,DC=example,DC=org", Filter: "(operatingSystem=*)"}},
+				ExporterPort: 9182,
+			},
+		},
+	}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Invalid configuration: %s", err)
+	}
+
+	c.LdapConfig.MaxReconnectAttempts = 5
+	generated := map[string]*BaseDnMapping{
+		"site-montreal": {BaseDnList: []*BaseDn{{DN: "OU=Montreal,OU=Sites,DC=example,DC=org"}}, Filter: "(location=Montreal)", ExporterPort: 9182},
+	}
+
+	out, err := c.Serialize(generated)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(out, "ro_user") || !strings.Contains(out, "bind_dn: "+Redacted) {
+		t.Errorf("Expecting the bind DN to be redacted, got:\n%s", out)
+	}
+	if strings.Contains(strings.ToLower(out), "maxreconnectattempts") {
+		t.Errorf("Expecting the internal reconnection attempts not to be served, got:\n%s", out)
+	}
+	if c.LdapConfig.BindDN != "CN=ro_user,DC=example,DC=org" {
+		t.Errorf("Expecting the configuration to be unchanged, got bind DN %q", c.LdapConfig.BindDN)
+	}
+
+	out, err = c.SerializeJSON(generated)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var effective struct {
+		Host       string `json:"server_host"`
+		LdapConfig struct {
+			BindDN   string `json:"bind_dn"`
+			CacheDir string `json:"cache_dir"`
+		} `json:"ldap_config"`
+		EffectiveFilters struct {
+			TargetGroups map[string][]struct {
+				BaseDn string `json:"base_dn"`
+				Filter string `json:"filter"`
+			} `json:"target_groups"`
+			GeneratedTargetGroups map[string][]struct {
+				BaseDn string `json:"base_dn"`
+				Filter string `json:"filter"`
+			} `json:"generated_target_groups"`
+		} `json:"effective_filters"`
+	}
+	if err := json.Unmarshal([]byte(out), &effective); err != nil {
+		t.Fatalf("Invalid JSON configuration: %s", err)
+	}
+	if effective.Host != "127.0.0.1" || effective.LdapConfig.BindDN != Redacted || !filepath.IsAbs(effective.LdapConfig.CacheDir) {
+		t.Errorf("Unexpected effective configuration: %+v", effective)
+	}
+	filters := effective.EffectiveFilters.TargetGroups["servers"]
+	if len(filters) != 2 || filters[0].Filter != DefaultFilter ||
+		filters[1].BaseDn != "OU=Appliances,DC=example,DC=org" || filters[1].Filter != "(operatingSystem=*)" {
+		t.Errorf("Unexpected effective filters: %+v", filters)
+	}
+	generatedFilters := effective.EffectiveFilters.GeneratedTargetGroups["site-montreal"]
+	if len(generatedFilters) != 1 || generatedFilters[0].BaseDn != "OU=Montreal,OU=Sites,DC=example,DC=org" || generatedFilters[0].Filter != "(location=Montreal)" {
+		t.Errorf("Unexpected effective filters of the generated group: %+v", generatedFilters)
+	}
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"bytes"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConnectionChanged returns true if the settings used to connect and bind to the server differ
+// between the configurations
+func (c *LdapConfig) ConnectionChanged(o *LdapConfig) bool {
+	return c.URL != o.URL ||
+		c.BindDN != o.BindDN ||
+		c.PasswordEnvVar != o.PasswordEnvVar ||
+		c.Authenticated != o.Authenticated ||
+		c.Unsecured != o.Unsecured
+}
+
+// ChangedGroups returns the sorted names of the target groups of the configuration which are
+// removed or changed in the other configuration.  All the target groups are returned when an
+// option shared by every group, such as the server or the global filter, changed.
+func (c *LdapConfig) ChangedGroups(o *LdapConfig) []string {
+	globalChanged := !sameYAML(c.globalOptions(), o.globalOptions())
+
+	changed := []string{}
+	for name, m := range c.BaseDnMappings {
+		if other, ok := o.BaseDnMappings[name]; globalChanged || !ok || !sameYAML(m, other) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// ChangedTemplates returns the sorted names of the group templates of the configuration which are
+// removed or changed in the other configuration, all of them when a shared option changed
+func (c *LdapConfig) ChangedTemplates(o *LdapConfig) []string {
+	globalChanged := !sameYAML(c.globalOptions(), o.globalOptions())
+
+	changed := []string{}
+	for name, t := range c.GroupTemplates {
+		if other, ok := o.GroupTemplates[name]; globalChanged || !ok || !sameYAML(t, other) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// globalOptions returns a copy of the configuration without its target groups, group templates
+// and cache options, which don't change the discovered objects
+func (c *LdapConfig) globalOptions() LdapConfig {
+	global := *c
+	global.BaseDnMappings = nil
+	global.GroupTemplates = nil
+	global.CacheDir = ""
+	global.CacheTTL = 0
+	global.MaxReconnectAttempts = 0
+	return global
+}
+
+// sameYAML returns true if both values have the same YAML representation
+func sameYAML(a, b interface{}) bool {
+	x, errA := yaml.Marshal(a)
+	y, errB := yaml.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(x, y)
+}
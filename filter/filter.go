@@ -0,0 +1,402 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The filter package parses LDAP search filters (see https://tools.ietf.org/html/rfc4515) so that
+// invalid filters are reported when the configuration is loaded rather than when the server
+// rejects the search, and so that filters can be combined without mangling their parentheses.
+
+// Filter is a node of a parsed LDAP filter
+type Filter interface {
+	// String returns the RFC 4515 string representation of the filter
+	String() string
+}
+
+// And matches the entries matched by all of its filters
+type And []Filter
+
+// Or matches the entries matched by any of its filters
+type Or []Filter
+
+// Not matches the entries not matched by its filter
+type Not struct {
+	Filter Filter
+}
+
+// Present matches the entries having a value for the attribute, as in (attr=*)
+type Present struct {
+	Attr string
+}
+
+// Comparison matches the entries of which a value of the attribute compares to the value with the
+// operator, one of =, >=, <= or ~=.  The value is kept escaped and may contain wildcards for =.
+type Comparison struct {
+	Attr  string
+	Op    string
+	Value string
+}
+
+// Extensible is an extensible match, as in (memberOf:1.2.840.113556.1.4.1941:=value)
+type Extensible struct {
+	Attr         string
+	DNAttributes bool
+	MatchingRule string
+	Value        string
+}
+
+func (f And) String() string {
+	return "(&" + joinFilters(f) + ")"
+}
+
+func (f Or) String() string {
+	return "(|" + joinFilters(f) + ")"
+}
+
+func (f Not) String() string {
+	return "(!" + f.Filter.String() + ")"
+}
+
+func (f Present) String() string {
+	return "(" + f.Attr + "=*)"
+}
+
+func (f Comparison) String() string {
+	return "(" + f.Attr + f.Op + f.Value + ")"
+}
+
+func (f Extensible) String() string {
+	var b strings.Builder
+	b.WriteString("(" + f.Attr)
+	if f.DNAttributes {
+		b.WriteString(":dn")
+	}
+	if f.MatchingRule != "" {
+		b.WriteString(":" + f.MatchingRule)
+	}
+	b.WriteString(":=" + f.Value + ")")
+	return b.String()
+}
+
+func joinFilters(filters []Filter) string {
+	var b strings.Builder
+	for _, f := range filters {
+		b.WriteString(f.String())
+	}
+	return b.String()
+}
+
+// Combine returns the conjunction of the filters.  Nested conjunctions are flattened and identical
+// filters are kept once, so that combining (&(objectClass=computer)) with
+// (&(objectClass=computer)(operatingSystem=Windows*)) gives (&(objectClass=computer)(operatingSystem=Windows*)).
+// Nil filters are ignored and nil is returned when there are no filters.
+func Combine(filters ...Filter) Filter {
+	combined := And{}
+	seen := map[string]bool{}
+	var add func(f Filter)
+	add = func(f Filter) {
+		switch v := f.(type) {
+		case nil:
+		case And:
+			for _, child := range v {
+				add(child)
+			}
+		default:
+			if !seen[f.String()] {
+				seen[f.String()] = true
+				combined = append(combined, f)
+			}
+		}
+	}
+	for _, f := range filters {
+		add(f)
+	}
+
+	switch len(combined) {
+	case 0:
+		return nil
+	case 1:
+		return combined[0]
+	}
+	return combined
+}
+
+// Error is a filter syntax error at a position of the filter
+type Error struct {
+	Filter string
+	// Pos is the 1-based position of the character at which the error was found
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at position %d of filter %q", e.Msg, e.Pos, e.Filter)
+}
+
+// MustParse works like Parse, but panics if the filter is invalid
+func MustParse(s string) Filter {
+	f, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// whitespace are the characters ignored before and after a filter
+const whitespace = " \t\r\n"
+
+// Parse parses an LDAP filter.  The outer parentheses of a single item can be omitted, as in
+// objectClass=computer.
+func Parse(s string) (Filter, error) {
+	p := &parser{input: s, end: len(strings.TrimRight(s, whitespace))}
+	p.skipSpaces()
+	if p.pos >= p.end {
+		return nil, p.errorf("empty filter")
+	}
+
+	var f Filter
+	var err error
+	if p.input[p.pos] == '(' {
+		f, err = p.parseFilter()
+	} else {
+		f, err = p.parseItem()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < p.end {
+		return nil, p.errorf("unexpected %q after the end of the filter", p.input[p.pos])
+	}
+	return f, nil
+}
+
+type parser struct {
+	input string
+	pos   int
+	end   int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &Error{Filter: p.input, Pos: p.pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < p.end && strings.IndexByte(whitespace, p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *parser) expect(c byte) error {
+	if p.pos >= p.end {
+		return p.errorf("expected %q but the filter ended", c)
+	}
+	if p.input[p.pos] != c {
+		return p.errorf("expected %q but found %q", c, p.input[p.pos])
+	}
+	p.pos++
+	return nil
+}
+
+// parseFilter parses a parenthesized filter
+func (p *parser) parseFilter() (Filter, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	if p.pos >= p.end {
+		return nil, p.errorf("unclosed parenthesis")
+	}
+
+	var f Filter
+	switch p.input[p.pos] {
+	case '&', '|':
+		op := p.input[p.pos]
+		p.pos++
+		filters, err := p.parseList(op)
+		if err != nil {
+			return nil, err
+		}
+		if op == '&' {
+			f = And(filters)
+		} else {
+			f = Or(filters)
+		}
+	case '!':
+		p.pos++
+		child, err := p.parseFilter()
+		if err != nil {
+			return nil, err
+		}
+		f = Not{Filter: child}
+	default:
+		item, err := p.parseItem()
+		if err != nil {
+			return nil, err
+		}
+		f = item
+	}
+
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseList parses the filters of a conjunction or disjunction
+func (p *parser) parseList(op byte) ([]Filter, error) {
+	filters := []Filter{}
+	for p.pos < p.end && p.input[p.pos] == '(' {
+		f, err := p.parseFilter()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 0 {
+		return nil, p.errorf("expected at least one filter after %q", op)
+	}
+	return filters, nil
+}
+
+// parseItem parses a simple, present, substring or extensible match filter, without its parentheses
+func (p *parser) parseItem() (Filter, error) {
+	start := p.pos
+	for p.pos < p.end && !strings.ContainsRune("=~<>:()", rune(p.input[p.pos])) {
+		p.pos++
+	}
+	attr := p.input[start:p.pos]
+	if p.pos >= p.end {
+		return nil, p.errorf("missing filter operator")
+	}
+
+	if p.input[p.pos] == ':' {
+		return p.parseExtensible(start, attr)
+	}
+
+	if !isAttributeDescription(attr) {
+		return nil, &Error{Filter: p.input, Pos: start + 1, Msg: fmt.Sprintf("invalid attribute description %q", attr)}
+	}
+
+	var op string
+	switch p.input[p.pos] {
+	case '=':
+		op = "="
+	case '~', '<', '>':
+		if p.pos+1 >= p.end || p.input[p.pos+1] != '=' {
+			p.pos++
+			return nil, p.errorf("expected '=' after %q", p.input[p.pos-1])
+		}
+		op = p.input[p.pos : p.pos+2]
+	default:
+		return nil, p.errorf("unexpected %q in attribute description", p.input[p.pos])
+	}
+	p.pos += len(op)
+
+	value, err := p.parseValue(op == "=")
+	if err != nil {
+		return nil, err
+	}
+	if op == "=" && value == "*" {
+		return Present{Attr: attr}, nil
+	}
+	return Comparison{Attr: attr, Op: op, Value: value}, nil
+}
+
+// parseExtensible parses an extensible match after its attribute description
+func (p *parser) parseExtensible(start int, attr string) (Filter, error) {
+	f := Extensible{Attr: attr}
+	if attr != "" && !isAttributeDescription(attr) {
+		return nil, &Error{Filter: p.input, Pos: start + 1, Msg: fmt.Sprintf("invalid attribute description %q", attr)}
+	}
+
+	for p.pos < p.end && p.input[p.pos] == ':' {
+		p.pos++
+		if p.pos < p.end && p.input[p.pos] == '=' {
+			p.pos++
+			if f.Attr == "" && f.MatchingRule == "" {
+				return nil, &Error{Filter: p.input, Pos: start + 1, Msg: "extensible match requires an attribute or a matching rule"}
+			}
+			value, err := p.parseValue(false)
+			if err != nil {
+				return nil, err
+			}
+			f.Value = value
+			return f, nil
+		}
+
+		partStart := p.pos
+		for p.pos < p.end && !strings.ContainsRune(":=()", rune(p.input[p.pos])) {
+			p.pos++
+		}
+		part := p.input[partStart:p.pos]
+		switch {
+		case strings.EqualFold(part, "dn") && !f.DNAttributes && f.MatchingRule == "":
+			f.DNAttributes = true
+		case isOID(part) || isDescriptor(part):
+			if f.MatchingRule != "" {
+				return nil, &Error{Filter: p.input, Pos: partStart + 1, Msg: "extensible match has more than one matching rule"}
+			}
+			f.MatchingRule = part
+		default:
+			return nil, &Error{Filter: p.input, Pos: partStart + 1, Msg: fmt.Sprintf("invalid matching rule %q", part)}
+		}
+	}
+	return nil, p.errorf("expected ':=' in extensible match")
+}
+
+// parseValue parses an assertion value up to the closing parenthesis, validating its escape sequences
+func (p *parser) parseValue(allowWildcards bool) (string, error) {
+	start := p.pos
+	for p.pos < p.end && p.input[p.pos] != ')' {
+		switch c := p.input[p.pos]; c {
+		case '(':
+			return "", p.errorf("unescaped '(' in value, use \\28")
+		case '*':
+			if !allowWildcards {
+				return "", p.errorf("unescaped '*' in value, use \\2a")
+			}
+		case '\\':
+			if p.pos+2 >= p.end || !isHex(p.input[p.pos+1]) || !isHex(p.input[p.pos+2]) {
+				return "", p.errorf("invalid escape sequence, expected two hexadecimal digits after '\\'")
+			}
+			p.pos += 2
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos], nil
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// isAttributeDescription returns true for an attribute type (descriptor or OID) with options
+func isAttributeDescription(s string) bool {
+	parts := strings.Split(s, ";")
+	if !isDescriptor(parts[0]) && !isOID(parts[0]) {
+		return false
+	}
+	for _, option := range parts[1:] {
+		if option == "" || strings.Trim(option, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func isDescriptor(s string) bool {
+	if s == "" || !((s[0] >= 'a' && s[0] <= 'z') || (s[0] >= 'A' && s[0] <= 'Z')) {
+		return false
+	}
+	return strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-") == ""
+}
+
+func isOID(s string) bool {
+	for _, part := range strings.Split(s, ".") {
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package filter
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+
+	tests := map[string]string{
+		"(objectClass=computer)":                                       "(objectClass=computer)",
+		"objectClass=computer":                                         "(objectClass=computer)",
+		"  (&(objectClass=computer)(operatingSystem=Windows*))  ":      "(&(objectClass=computer)(operatingSystem=Windows*))",
+		"(|(cn=host\\2a)(!(dNSHostName=*)))":                           "(|(cn=host\\2a)(!(dNSHostName=*)))",
+		"(&(lastLogonTimestamp>=133000000000000000)(cn~=web))":         "(&(lastLogonTimestamp>=133000000000000000)(cn~=web))",
+		"(memberOf:1.2.840.113556.1.4.1941:=CN=Web,DC=example,DC=org)": "(memberOf:1.2.840.113556.1.4.1941:=CN=Web,DC=example,DC=org)",
+		"(userAccountControl:1.2.840.113556.1.4.803:=2)":               "(userAccountControl:1.2.840.113556.1.4.803:=2)",
+		"(ou:dn:=Servers)":                                             "(ou:dn:=Servers)",
+		"(:caseExactMatch:=Web)":                                       "(:caseExactMatch:=Web)",
+		"(2.5.4.3=host01)":                                             "(2.5.4.3=host01)",
+		"(description=)":                                               "(description=)",
+		"\n\t(objectClass=computer)\r\n":                               "(objectClass=computer)",
+	}
+	for s, expected := range tests {
+		f, err := Parse(s)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("Expecting error for filter %q", s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for filter %q: %s", s, err)
+			continue
+		}
+		if f.String() != expected {
+			t.Errorf("Expecting filter %q, got %q", expected, f.String())
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+
+	tests := []struct {
+		filter string
+		pos    int
+	}{
+		{"", 1},
+		{" \t\r\n", 1},
+		{"(objectClass=computer", 22},
+		{"(&(objectClass=computer)(cn=web)", 33},
+		{"(&)", 3},
+		{"(&(objectClass=computer)))", 26},
+		{"(objectClass=comp(uter)", 18},
+		{"(cn=web\\2)", 8},
+		{"(cn=web\\zz)", 8},
+		{"(cn>web)", 5},
+		{"(c n=web)", 2},
+		{"(objectClass)", 13},
+		{"(cn>=web*)", 9},
+		{"(memberOf:1.2.foo:=x)", 11},
+		{"(:=x)", 2},
+		{"(&(objectClass=computer)(operatingSystem=Windows*) )", 51},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.filter)
+		ferr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("Expecting filter error for %q, got %v", test.filter, err)
+			continue
+		}
+		if ferr.Pos != test.pos {
+			t.Errorf("Expecting error at position %d for %q, got %s", test.pos, test.filter, ferr)
+		}
+	}
+}
+
+func TestCombine(t *testing.T) {
+
+	tests := []struct {
+		filters  []Filter
+		expected string
+	}{
+		{[]Filter{MustParse("(&(objectClass=computer))"), MustParse("(&(objectClass=computer)(operatingSystem=Windows*))")}, "(&(objectClass=computer)(operatingSystem=Windows*))"},
+		{[]Filter{MustParse("(objectClass=computer)"), MustParse("(|(cn=a)(cn=b))")}, "(&(objectClass=computer)(|(cn=a)(cn=b)))"},
+		{[]Filter{nil, MustParse("objectClass=computer")}, "(objectClass=computer)"},
+		{[]Filter{MustParse("(&(a=1)(b=2))"), MustParse("(&(b=2)(c=3))")}, "(&(a=1)(b=2)(c=3))"},
+	}
+	for _, test := range tests {
+		if res := Combine(test.filters...).String(); res != test.expected {
+			t.Errorf("Expecting combined filter %q, got %q", test.expected, res)
+		}
+	}
+	if Combine(nil, nil) != nil {
+		t.Errorf("Expecting nil filter when combining no filters")
+	}
+}
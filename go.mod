@@ -1,20 +1,41 @@
 module github.com/hartfordfive/prometheus-ldap-sd-server
 
-go 1.15
+go 1.26.0
 
 require (
+	github.com/go-asn1-ber/asn1-ber v1.5.4
 	github.com/go-ldap/ldap/v3 v3.4.3
 	github.com/gorilla/mux v1.8.0
-	github.com/prometheus/client_golang v1.11.0
-	go.uber.org/zap v1.17.0
-	gopkg.in/yaml.v2 v2.3.0
+	github.com/prometheus/client_golang v1.24.1
+	github.com/prometheus/prometheus v0.315.0
+	go.uber.org/zap v1.28.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20211209120228-48547f28849e // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/golang/protobuf v1.5.4 // indirect
+	github.com/grafana/regexp v0.0.0-20250905093917-f7b3be9d1853 // indirect
+	github.com/mediocregopher/radix/v3 v3.8.1 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.3 // indirect
+	github.com/prometheus/procfs v0.21.1 // indirect
+	github.com/rogpeppe/go-internal v1.14.1 // indirect
+	github.com/vmihailenco/msgpack v4.0.1+incompatible // indirect
+	go.uber.org/multierr v1.11.0 // indirect
+	golang.org/x/crypto v0.56.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.41.0 // indirect
+	google.golang.org/appengine v1.6.8 // indirect
+	google.golang.org/protobuf v1.36.12 // indirect
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
 
 require (
-	github.com/djherbis/fscache v0.10.1
 	github.com/gadelkareem/cachita v0.2.3
-	github.com/kr/pretty v0.2.0 // indirect
-	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
-	gopkg.in/djherbis/atime.v1 v1.0.0 // indirect
-	gopkg.in/djherbis/stream.v1 v1.3.1 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
+	github.com/prometheus/common v0.71.0
+	golang.org/x/xerrors v0.0.0-20240903120638-7835f813f4da // indirect
 )
@@ -37,7 +37,7 @@ var ShowTargetsHandler = func(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	targetGroup := req.URL.Query().Get("targetGroup")
 	dataStore := store.StoreInstance
-	res, err := dataStore.Serialize(targetGroup)
+	res, err := dataStore.Serialize(req.Context(), targetGroup)
 	if err != nil {
 		fmt.Fprint(w, "[]\n")
 		return
@@ -46,13 +46,23 @@ var ShowTargetsHandler = func(w http.ResponseWriter, req *http.Request) {
 }
 
 var ShowConfigHandler = func(w http.ResponseWriter, req *http.Request) {
+	cnf := config.GlobalConfig()
+	if cnf.DisableConfigEndpoint {
+		http.NotFound(w, req)
+		return
+	}
 	logger.Logger.Info("Debug config requested")
-	w.Header().Set("Content-Type", "text/yaml")
-	printCnf, err := config.GlobalConfig.Serialize()
+
+	contentType, serialize := "text/yaml", cnf.Serialize
+	if req.URL.Query().Get("format") == "json" {
+		contentType, serialize = "application/json", cnf.SerializeJSON
+	}
+	printCnf, err := serialize(store.StoreInstance.GeneratedGroups())
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", contentType)
 	fmt.Fprintf(w, "%s\n", printCnf)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	defaultLogger "log"
@@ -9,6 +10,7 @@ import (
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
@@ -16,6 +18,7 @@ import (
 	"github.com/go-ldap/ldap/v3"
 	"github.com/gorilla/mux"
 	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/handler"
 	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
 	"github.com/hartfordfive/prometheus-ldap-sd-server/metrics"
 	"github.com/hartfordfive/prometheus-ldap-sd-server/store"
@@ -29,13 +32,22 @@ import (
 
 var dataStore store.DataStore
 
+const (
+	writeTimeout = 10 * time.Second
+	// discoveryTimeout bounds the DNS resolution and exporter probes of a target listing request
+	discoveryTimeout = 8 * time.Second
+)
+
+// reloadLock serializes the configuration reloads triggered by SIGHUP and the reload endpoint
+var reloadLock sync.Mutex
+
 var (
-	flagConfPath       *string
-	flagDebug          *bool
-	flagVersion        *bool
-	flagValidateConfig *bool
-	log                *zap.Logger
-	conf               *config.Config
+	flagConfPath        *string
+	flagDebug           *bool
+	flagVersion         *bool
+	flagValidateConfig  *bool
+	flagEnableLifecycle *bool
+	log                 *zap.Logger
 )
 
 func init() {
@@ -48,6 +60,7 @@ func init() {
 	flagVersion = flag.Bool("version", false, "Show version and exit")
 	flagDebug = flag.Bool("debug", false, "Enable debug mode")
 	flagValidateConfig = flag.Bool("validate", false, "Validate config and exit")
+	flagEnableLifecycle = flag.Bool("web.enable-lifecycle", false, "Enable the /-/reload endpoint to reload the configuration over HTTP")
 	flag.Parse()
 
 	prometheus.Register(metrics.MetricBuildInfo)
@@ -58,6 +71,19 @@ func init() {
 	prometheus.Register(metrics.MetricCacheUpdateFail)
 	prometheus.Register(metrics.MetricReconnect)
 	prometheus.Register(metrics.MetricGroupNumObjects)
+	prometheus.Register(metrics.MetricGroupExcludedObjects)
+	prometheus.Register(metrics.MetricGroupProbedTargets)
+	prometheus.Register(metrics.MetricGroupDuplicatesRemoved)
+	prometheus.Register(metrics.MetricReferrals)
+	prometheus.Register(metrics.MetricSearchFailed)
+	prometheus.Register(metrics.MetricSearchLastSuccess)
+	prometheus.Register(metrics.MetricGroupGuardrailRejections)
+	prometheus.Register(metrics.MetricGroupGuardrailTriggered)
+	prometheus.Register(metrics.MetricGeneratedTargetGroups)
+	prometheus.Register(metrics.MetricGroupTemplateRefreshFailed)
+	prometheus.Register(metrics.MetricConfigReloads)
+	prometheus.Register(metrics.MetricConfigLastReloadSuccessful)
+	prometheus.Register(metrics.MetricConfigLastReloadSuccessTimestamp)
 
 	var log *zap.Logger
 	var loggerErr error
@@ -97,7 +123,7 @@ func init() {
 		logger.Logger.Error(fmt.Sprintf("%s", err))
 		os.Exit(1)
 	}
-	conf = cnf
+	config.SetGlobalConfig(cnf)
 
 }
 
@@ -110,14 +136,158 @@ func prometheusMiddleware(next http.Handler) http.Handler {
 }
 
 func validateConfig(cnf *config.Config) int {
-	if cnf.Validate() != nil {
+	if err := cnf.Validate(); err != nil {
+		logger.Logger.Error(err.Error())
 		return 1
 	}
+	reportGlobalCatalogAttributes(cnf.LdapConfig)
+	reportEffectiveFilters(cnf.LdapConfig)
 	return 0
 }
 
+// reportGlobalCatalogAttributes warns about the attributes requested by the target groups searching
+// the Global Catalog which aren't part of its partial attribute set, and so are never returned
+func reportGlobalCatalogAttributes(c *config.LdapConfig) {
+	groups := make([]string, 0, len(c.BaseDnMappings))
+	for name := range c.BaseDnMappings {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+	for _, name := range groups {
+		if attributes := c.NonReplicatedAttributes(c.BaseDnMappings[name]); len(attributes) > 0 {
+			logger.Logger.Warn("Attributes aren't replicated to the Global Catalog and won't be returned",
+				zap.String("group_name", name),
+				zap.Strings("attributes", attributes))
+		}
+	}
+
+	templates := make([]string, 0, len(c.GroupTemplates))
+	for name := range c.GroupTemplates {
+		templates = append(templates, name)
+	}
+	sort.Strings(templates)
+	for _, name := range templates {
+		if attributes := c.NonReplicatedAttributes(c.GroupTemplates[name].Mapping); len(attributes) > 0 {
+			logger.Logger.Warn("Attributes aren't replicated to the Global Catalog and won't be returned",
+				zap.String("template_name", name),
+				zap.Strings("attributes", attributes))
+		}
+	}
+}
+
+// reportEffectiveFilters logs the filter used to search each base DN of each target group
+func reportEffectiveFilters(c *config.LdapConfig) {
+	groupFilters, templateFilters, err := c.EffectiveFilters()
+	if err != nil {
+		logger.Logger.Error("Could not build the effective filters", zap.String("error", err.Error()))
+		return
+	}
+
+	groups := make([]string, 0, len(groupFilters))
+	for name := range groupFilters {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+	for _, name := range groups {
+		for _, f := range groupFilters[name] {
+			fields := []zap.Field{zap.String("group_name", name)}
+			if f.BaseDn != "" {
+				fields = append(fields, zap.String("base_dn", f.BaseDn))
+			}
+			logger.Logger.Info("Effective filter", append(fields, zap.String("filter", f.Filter))...)
+		}
+	}
+
+	templates := make([]string, 0, len(templateFilters))
+	for name := range templateFilters {
+		templates = append(templates, name)
+	}
+	sort.Strings(templates)
+	for _, name := range templates {
+		logger.Logger.Info("Effective filter",
+			zap.String("template_name", name),
+			zap.String("filter", templateFilters[name][0].Filter))
+	}
+}
+
+// reloadConfig reads the configuration file again and, when it's valid, swaps the configuration of
+// the store.  The listening address of the server can't be changed without a restart.
+func reloadConfig(ldapStore *store.LdapStore) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	logger.Logger.Info("Reloading configuration", zap.String("path", *flagConfPath))
+	cnf, err := config.NewConfig(*flagConfPath)
+	if err == nil {
+		err = ldapStore.Reload(cnf.LdapConfig)
+	}
+	if err != nil {
+		logger.Logger.Error("Could not reload configuration", zap.String("error", err.Error()))
+		metrics.MetricConfigReloads.WithLabelValues("failure").Inc()
+		metrics.MetricConfigLastReloadSuccessful.Set(0)
+		return err
+	}
+
+	previous := config.GlobalConfig()
+	if cnf.Host != previous.Host || cnf.Port != previous.Port {
+		logger.Logger.Warn("The server address can't be changed without a restart",
+			zap.String("address", fmt.Sprintf("%s:%d", previous.Host, previous.Port)))
+	}
+	reportGlobalCatalogAttributes(cnf.LdapConfig)
+	initGroupMetrics(cnf.LdapConfig, previous.LdapConfig)
+	config.SetGlobalConfig(cnf)
+
+	logger.Logger.Info("Configuration reloaded")
+	metrics.MetricConfigReloads.WithLabelValues("success").Inc()
+	metrics.MetricConfigLastReloadSuccessful.Set(1)
+	metrics.MetricConfigLastReloadSuccessTimestamp.SetToCurrentTime()
+	return nil
+}
+
+// initGroupMetrics initializes the metrics of the target groups and group templates which aren't
+// part of the previous configuration, so that they're exposed before the first discovery
+func initGroupMetrics(c *config.LdapConfig, previous *config.LdapConfig) {
+	if previous == nil {
+		previous = &config.LdapConfig{}
+	}
+	for targetGroup, mapping := range c.BaseDnMappings {
+		if _, ok := previous.BaseDnMappings[targetGroup]; ok {
+			continue
+		}
+		metrics.MetricServerRequestsFailed.WithLabelValues(targetGroup)
+		metrics.MetricServerRequests.WithLabelValues(targetGroup)
+		metrics.MetricRequestsFromCache.WithLabelValues(targetGroup)
+		metrics.MetricCacheUpdateSuccess.WithLabelValues(targetGroup)
+		metrics.MetricCacheUpdateFail.WithLabelValues(targetGroup)
+		metrics.MetricReconnect.Add(0)
+		metrics.MetricGroupNumObjects.WithLabelValues(targetGroup).Add(0)
+		metrics.MetricGroupDuplicatesRemoved.WithLabelValues(targetGroup).Set(0)
+		metrics.MetricGroupExcludedObjects.WithLabelValues(targetGroup, store.ExcludeReasonDisabled)
+		metrics.MetricGroupExcludedObjects.WithLabelValues(targetGroup, store.ExcludeReasonStale)
+		metrics.MetricGroupExcludedObjects.WithLabelValues(targetGroup, store.ExcludeReasonNoHostname)
+		metrics.MetricGroupExcludedObjects.WithLabelValues(targetGroup, store.ExcludeReasonUnresolved)
+		metrics.MetricGroupGuardrailRejections.WithLabelValues(targetGroup, store.GuardrailShrink)
+		metrics.MetricGroupGuardrailRejections.WithLabelValues(targetGroup, store.GuardrailMaxObjects)
+		metrics.MetricGroupGuardrailTriggered.WithLabelValues(targetGroup).Set(0)
+		metrics.MetricReferrals.WithLabelValues(targetGroup, store.ReferralFollowed)
+		metrics.MetricReferrals.WithLabelValues(targetGroup, store.ReferralFailed)
+		for _, baseDn := range mapping.BaseDnList {
+			metrics.MetricSearchFailed.WithLabelValues(targetGroup, baseDn.DN).Set(0)
+		}
+	}
+	for templateName := range c.GroupTemplates {
+		if _, ok := previous.GroupTemplates[templateName]; ok {
+			continue
+		}
+		metrics.MetricGeneratedTargetGroups.WithLabelValues(templateName).Set(0)
+		metrics.MetricGroupTemplateRefreshFailed.WithLabelValues(templateName)
+	}
+}
+
 func main() {
 
+	conf := config.GlobalConfig()
+
 	if *flagValidateConfig {
 		logger.Logger.Info("Validating configuration", zap.String("path", *flagConfPath))
 		res := validateConfig(conf)
@@ -130,43 +300,27 @@ func main() {
 	var err error
 
 	logger.Logger.Info("Starting server")
-
-	config.GlobalConfig = conf
+	reportGlobalCatalogAttributes(conf.LdapConfig)
 
 	logger.Logger.Debug(fmt.Sprintf("Cache TTL set to %ds", conf.LdapConfig.CacheTTL))
 
 	// Init datastore
-	store.StoreInstance, err = store.NewLdapStore(
-		conf.LdapConfig.URL,
-		conf.LdapConfig.BindDN,
-		conf.LdapConfig.BaseDnMappings,
-		conf.LdapConfig.Filter,
-		conf.LdapConfig.DefaultAttributes,
-		conf.LdapConfig.PasswordEnvVar,
-		conf.LdapConfig.Authenticated,
-		conf.LdapConfig.Unsecured,
-		conf.LdapConfig.CacheDir,
-		conf.LdapConfig.CacheTTL,
-	)
+	ldapStore, err := store.NewLdapStoreFromConfig(conf.LdapConfig)
 	if err != nil {
 		logger.Logger.Error(err.Error())
 		os.Exit(1)
 	}
+	store.StoreInstance = ldapStore
 
 	// The ldap package Logger function can't use the zap.Logger struct, so we have to create a seperate one
 	ldap.Logger(defaultLogger.New(os.Stdout, "", defaultLogger.LstdFlags))
 
 	metrics.MetricBuildInfo.WithLabelValues(version.Version, version.CommitHash).Inc()
 
-	for targetGroup, _ := range conf.LdapConfig.BaseDnMappings {
-		metrics.MetricServerRequestsFailed.WithLabelValues(targetGroup)
-		metrics.MetricServerRequests.WithLabelValues(targetGroup)
-		metrics.MetricRequestsFromCache.WithLabelValues(targetGroup)
-		metrics.MetricCacheUpdateSuccess.WithLabelValues(targetGroup)
-		metrics.MetricCacheUpdateFail.WithLabelValues(targetGroup)
-		metrics.MetricReconnect.Add(0)
-		metrics.MetricGroupNumObjects.WithLabelValues(targetGroup).Add(0)
-	}
+	initGroupMetrics(conf.LdapConfig, nil)
+	metrics.MetricConfigLastReloadSuccessful.Set(1)
+	metrics.MetricConfigLastReloadSuccessTimestamp.SetToCurrentTime()
+	ldapStore.StartGroupTemplates()
 
 	listenAddr := fmt.Sprintf("%s:%d", conf.Host, conf.Port)
 
@@ -174,7 +328,7 @@ func main() {
 	srv := &http.Server{
 		Handler:      r,
 		Addr:         listenAddr,
-		WriteTimeout: 10 * time.Second,
+		WriteTimeout: writeTimeout,
 		ReadTimeout:  10 * time.Second,
 	}
 
@@ -186,7 +340,10 @@ func main() {
 
 		w.Header().Set("Content-Type", "application/json")
 		targetGroup := req.URL.Query().Get("targetGroup")
-		res, err := store.StoreInstance.Serialize(targetGroup)
+		// Leave enough time to write the response before the write timeout of the server
+		ctx, cancel := context.WithTimeout(req.Context(), discoveryTimeout)
+		defer cancel()
+		res, err := store.StoreInstance.Serialize(ctx, targetGroup)
 
 		if err != nil {
 			logger.Logger.Error(err.Error())
@@ -204,18 +361,29 @@ func main() {
 
 	}).Methods("GET")
 
-	r.HandleFunc("/config", func(w http.ResponseWriter, req *http.Request) {
-		logger.Logger.Info("Debug config requested")
-		w.Header().Set("Content-Type", "text/yaml")
-		printCnf, err := config.GlobalConfig.Serialize()
+	r.HandleFunc("/config", handler.ShowConfigHandler).Methods("GET")
 
+	r.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		output, err := json.Marshal(ldapStore.Status())
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		fmt.Fprintf(w, "%s\n", printCnf)
+		fmt.Fprintf(w, "%s\n", output)
 	}).Methods("GET")
 
+	// The reload endpoint isn't authenticated, so it's only served when explicitly enabled
+	if *flagEnableLifecycle {
+		r.HandleFunc("/-/reload", func(w http.ResponseWriter, req *http.Request) {
+			if err := reloadConfig(ldapStore); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, "OK")
+		}).Methods("POST")
+	}
+
 	r.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
 		dataStore := store.StoreInstance
 		if dataStore.IsReady() {
@@ -246,9 +414,14 @@ func main() {
 	var wg sync.WaitGroup
 	wg.Add(1)
 
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
 	go func() {
 		for {
 			select {
+			case <-reloadChan:
+				reloadConfig(ldapStore)
 			case killSig := <-interruptChan:
 				if killSig == os.Interrupt || killSig == syscall.SIGTERM {
 					logger.Logger.Info("Received shutdown notification")
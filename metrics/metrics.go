@@ -49,6 +49,25 @@ var (
 		},
 		[]string{"group_name"},
 	)
+	MetricConfigReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ldap_sd_config_reloads_total",
+			Help: "Number of configuration reloads, by result (success or failure).",
+		},
+		[]string{"result"},
+	)
+	MetricConfigLastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ldap_sd_config_last_reload_successful",
+			Help: "Set to 1 when the last configuration reload succeeded.",
+		},
+	)
+	MetricConfigLastReloadSuccessTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ldap_sd_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		},
+	)
 	MetricReconnect = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "ldap_sd_connect_total",
@@ -62,6 +81,76 @@ var (
 		},
 		[]string{"group_name"},
 	)
+	MetricGroupProbedTargets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ldap_sd_target_group_probed_targets",
+			Help: "Number of targets of the target group found reachable or unreachable by the last exporter probe.",
+		},
+		[]string{"group_name", "status"},
+	)
+	MetricGroupDuplicatesRemoved = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ldap_sd_target_group_duplicates_removed",
+			Help: "Number of duplicated objects or targets removed from the target group during the last refresh.",
+		},
+		[]string{"group_name"},
+	)
+	MetricGeneratedTargetGroups = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ldap_sd_group_template_target_groups",
+			Help: "Number of target groups generated by the group template during the last refresh.",
+		},
+		[]string{"template_name"},
+	)
+	MetricGroupTemplateRefreshFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ldap_sd_group_template_refresh_failed_total",
+			Help: "Number of failed refreshes of the target groups generated by the group template.",
+		},
+		[]string{"template_name"},
+	)
+	MetricReferrals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ldap_sd_referrals_total",
+			Help: "Number of referrals returned by the searches of the target group, by result (followed or failed).",
+		},
+		[]string{"group_name", "result"},
+	)
+	MetricSearchFailed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ldap_sd_base_dn_search_failed",
+			Help: "Set to 1 when the last search of the base DN, or group, of the target group failed.",
+		},
+		[]string{"group_name", "base_dn"},
+	)
+	MetricSearchLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ldap_sd_base_dn_last_success_timestamp_seconds",
+			Help: "Timestamp of the last successful search of the base DN, or group, of the target group.",
+		},
+		[]string{"group_name", "base_dn"},
+	)
+	MetricGroupGuardrailRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ldap_sd_target_group_guardrail_rejections_total",
+			Help: "Number of refreshes of the target group rejected by its guardrails, by reason.",
+		},
+		[]string{"group_name", "reason"},
+	)
+	MetricGroupGuardrailTriggered = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ldap_sd_target_group_guardrail_triggered",
+			Help: "Set to 1 when the last refresh of the target group was rejected by its guardrails and the previous objects are served.",
+		},
+		[]string{"group_name"},
+	)
+	MetricGroupExcludedObjects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ldap_sd_target_group_excluded_objects_total",
+			Help: "Number of discovered objects excluded from the target group, by reason.",
+		},
+		[]string{"group_name", "reason"},
+	)
 )
 
 type responseWriter struct {
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+// userAccountControl flags, see https://docs.microsoft.com/en-us/troubleshoot/windows-server/identity/useraccountcontrol-manipulate-account-properties
+const (
+	uacAccountDisable          = 0x0002
+	uacServerTrustAccount      = 0x2000
+	uacWorkstationTrustAccount = 0x1000
+)
+
+var uacFlagNames = []struct {
+	flag uint32
+	name string
+}{
+	{0x0001, "script"},
+	{uacAccountDisable, "account_disable"},
+	{0x0008, "homedir_required"},
+	{0x0010, "lockout"},
+	{0x0020, "passwd_notreqd"},
+	{0x0040, "passwd_cant_change"},
+	{0x0080, "encrypted_text_pwd_allowed"},
+	{0x0100, "temp_duplicate_account"},
+	{0x0200, "normal_account"},
+	{0x0800, "interdomain_trust_account"},
+	{uacWorkstationTrustAccount, "workstation_trust_account"},
+	{uacServerTrustAccount, "server_trust_account"},
+	{0x10000, "dont_expire_password"},
+	{0x20000, "mns_logon_account"},
+	{0x40000, "smartcard_required"},
+	{0x80000, "trusted_for_delegation"},
+	{0x100000, "not_delegated"},
+	{0x200000, "use_des_key_only"},
+	{0x400000, "dont_req_preauth"},
+	{0x800000, "password_expired"},
+	{0x1000000, "trusted_to_auth_for_delegation"},
+	{0x4000000, "partial_secrets_account"},
+}
+
+// filetimeEpochOffset is the number of 100ns intervals between 1601-01-01 and 1970-01-01
+const filetimeEpochOffset = 116444736000000000
+
+// parseUAC parses a userAccountControl value
+func parseUAC(value string) (uint32, error) {
+	uac, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if err != nil {
+		// The attribute is a signed 32 bit integer on some directories
+		signed, signedErr := strconv.ParseInt(strings.TrimSpace(value), 10, 32)
+		if signedErr != nil {
+			return 0, err
+		}
+		return uint32(signed), nil
+	}
+	return uint32(uac), nil
+}
+
+// uacFlags returns the names of the flags set in a userAccountControl value
+func uacFlags(uac uint32) []string {
+	flags := []string{}
+	for _, f := range uacFlagNames {
+		if uac&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	return flags
+}
+
+// parseFiletime parses a Windows FILETIME value, the number of 100ns intervals since
+// 1601-01-01 UTC.  The returned boolean is false for the 0 and max values which mean "never".
+func parseFiletime(value string) (time.Time, bool, error) {
+	ft, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if ft <= 0 || ft == math.MaxInt64 {
+		return time.Time{}, false, nil
+	}
+	ft -= filetimeEpochOffset
+	return time.Unix(ft/10000000, (ft%10000000)*100).UTC(), true, nil
+}
+
+// decodeGUID converts a binary objectGUID to its canonical string representation
+func decodeGUID(value string) (string, error) {
+	b := []byte(value)
+	if len(b) != 16 {
+		return "", fmt.Errorf("invalid GUID length %d", len(b))
+	}
+	// The first three components are stored in little-endian byte order
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10],
+		b[10:16]), nil
+}
+
+// decodeSID converts a binary objectSid to its canonical S-R-I-S-S... string representation
+func decodeSID(value string) (string, error) {
+	b := []byte(value)
+	if len(b) < 8 {
+		return "", fmt.Errorf("invalid SID length %d", len(b))
+	}
+	subAuthorityCount := int(b[1])
+	if len(b) != 8+4*subAuthorityCount {
+		return "", fmt.Errorf("invalid SID length %d for %d sub-authorities", len(b), subAuthorityCount)
+	}
+
+	var authority uint64
+	for _, v := range b[2:8] {
+		authority = authority<<8 | uint64(v)
+	}
+
+	sid := fmt.Sprintf("S-%d-%d", b[0], authority)
+	for i := 0; i < subAuthorityCount; i++ {
+		sid += fmt.Sprintf("-%d", binary.LittleEndian.Uint32(b[8+4*i:]))
+	}
+	return sid, nil
+}
+
+// decodeValue decodes a raw attribute value.  Values which can't be decoded are returned as-is.
+func decodeValue(value, decode, timeFormat string) (string, error) {
+	switch decode {
+	case config.DecodeGUID:
+		return decodeGUID(value)
+	case config.DecodeSID:
+		return decodeSID(value)
+	case config.DecodeFiletime:
+		t, set, err := parseFiletime(value)
+		if err != nil {
+			return value, err
+		}
+		if !set {
+			return "", nil
+		}
+		if timeFormat == config.TimeFormatEpoch {
+			return strconv.FormatInt(t.Unix(), 10), nil
+		}
+		return t.Format(time.RFC3339), nil
+	}
+	return value, nil
+}
+
+// uacLabels returns the labels describing the flags set in a userAccountControl value
+func uacLabels(labelName, value string) map[string]string {
+	uac, err := parseUAC(value)
+	if err != nil {
+		return map[string]string{}
+	}
+	flags := uacFlags(uac)
+	return map[string]string{
+		labelName + "_flags":    "," + strings.Join(flags, ",") + ",",
+		labelName + "_disabled": strconv.FormatBool(uac&uacAccountDisable != 0),
+	}
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+func TestDecodeGUIDAndSID(t *testing.T) {
+
+	guid := string([]byte{0x3f, 0x2e, 0x1d, 0x0c, 0x5b, 0x4a, 0x7d, 0x6c, 0x8e, 0x9f, 0xa0, 0xb1, 0xc2, 0xd3, 0xe4, 0xf5})
+	res, err := decodeGUID(guid)
+	if err != nil || res != "0c1d2e3f-4a5b-6c7d-8e9f-a0b1c2d3e4f5" {
+		t.Errorf("Unexpected GUID %q (error: %v)", res, err)
+	}
+	if _, err := decodeGUID("short"); err == nil {
+		t.Errorf("Expecting error for invalid GUID")
+	}
+
+	// S-1-5-21-1004336348-1177238915-682003330-512
+	sid := string([]byte{
+		0x01, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05,
+		0x15, 0x00, 0x00, 0x00,
+		0xdc, 0xf4, 0xdc, 0x3b,
+		0x83, 0x3d, 0x2b, 0x46,
+		0x82, 0x8b, 0xa6, 0x28,
+		0x00, 0x02, 0x00, 0x00,
+	})
+	res, err = decodeSID(sid)
+	if err != nil || res != "S-1-5-21-1004336348-1177238915-682003330-512" {
+		t.Errorf("Unexpected SID %q (error: %v)", res, err)
+	}
+	if _, err := decodeSID(sid[:10]); err == nil {
+		t.Errorf("Expecting error for invalid SID")
+	}
+}
+
+func TestParseFiletime(t *testing.T) {
+
+	ts, set, err := parseFiletime("132539328000000000")
+	if err != nil || !set || !ts.Equal(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected time %s (set: %v, error: %v)", ts, set, err)
+	}
+	for _, v := range []string{"0", "9223372036854775807"} {
+		if _, set, err := parseFiletime(v); err != nil || set {
+			t.Errorf("Expecting %s to be parsed as never set", v)
+		}
+	}
+	if _, _, err := parseFiletime("abc"); err == nil {
+		t.Errorf("Expecting error for invalid filetime")
+	}
+}
+
+func TestDecodedAttributeLabels(t *testing.T) {
+
+	// The well known attributes are only decoded by default with decode_ad_attributes
+	c := &config.LdapConfig{}
+	res := attributeLabels("lastLogonTimestamp", []string{"132539328000000000"}, nil, c.AttributeDecoding("lastLogonTimestamp", nil))
+	if res["__meta_ldap_last_logon_timestamp"] != "132539328000000000" {
+		t.Errorf("Expecting the raw value without decode_ad_attributes, got %v", res)
+	}
+
+	c.DecodeADAttributes = true
+	res = attributeLabels("userAccountControl", []string{"4098"}, nil, c.AttributeDecoding("userAccountControl", nil))
+	expected := map[string]string{
+		"__meta_ldap_user_account_control":          "4098",
+		"__meta_ldap_user_account_control_flags":    ",account_disable,workstation_trust_account,",
+		"__meta_ldap_user_account_control_disabled": "true",
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expecting %v, got %v", expected, res)
+	}
+
+	res = attributeLabels("lastLogonTimestamp", []string{"132539328000000000"}, nil, c.AttributeDecoding("lastLogonTimestamp", nil))
+	if res["__meta_ldap_last_logon_timestamp"] != "2021-01-01T00:00:00Z" {
+		t.Errorf("Unexpected labels %v", res)
+	}
+
+	opts := &config.AttributeOptions{TimeFormat: "epoch"}
+	if err := opts.Validate("pwdLastSet"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res = attributeLabels("pwdLastSet", []string{"132539328000000000"}, opts, c.AttributeDecoding("pwdLastSet", opts))
+	if res["__meta_ldap_pwd_last_set"] != "1609459200" {
+		t.Errorf("Unexpected labels %v", res)
+	}
+
+	opts = &config.AttributeOptions{Decode: "none"}
+	if err := opts.Validate("pwdLastSet"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res = attributeLabels("pwdLastSet", []string{"132539328000000000"}, opts, c.AttributeDecoding("pwdLastSet", opts))
+	if res["__meta_ldap_pwd_last_set"] != "132539328000000000" {
+		t.Errorf("Unexpected labels %v", res)
+	}
+}
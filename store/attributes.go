@@ -0,0 +1,96 @@
+package store
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+// attributeLabels returns the labels exposing the values of an LDAP attribute, according to
+// the attribute options of the target group and the decoding of the attribute.  Without options,
+// only the first value is kept.
+func attributeLabels(name string, values []string, opts *config.AttributeOptions, decode string) map[string]string {
+	labelName := fmt.Sprintf("%s%s", metaLabelPrefix, config.AttributeLabelName(name))
+	labels := map[string]string{}
+
+	multiValue := config.MultiValueFirst
+	timeFormat := config.TimeFormatRFC3339
+	if opts != nil {
+		multiValue = opts.MultiValue
+		timeFormat = opts.TimeFormat
+	}
+
+	if decode == config.DecodeUAC && len(values) >= 1 {
+		for k, v := range uacLabels(labelName, values[0]) {
+			labels[k] = v
+		}
+	}
+	if decode != config.DecodeNone && decode != config.DecodeUAC {
+		decoded := make([]string, 0, len(values))
+		for _, v := range values {
+			d, err := decodeValue(v, decode, timeFormat)
+			if err != nil {
+				// Raw binary values can't be used as label values
+				d = ""
+			}
+			decoded = append(decoded, d)
+		}
+		values = decoded
+	}
+
+	switch multiValue {
+	case config.MultiValueIndex:
+		for i, v := range values {
+			labels[fmt.Sprintf("%s_%d", labelName, i)] = v
+		}
+	case config.MultiValueJoin:
+		value := strings.Join(values, opts.Separator)
+		if opts.Enclose && len(values) >= 1 {
+			value = opts.Separator + value + opts.Separator
+		}
+		labels[labelName] = value
+	case config.MultiValueLast:
+		labels[labelName] = ""
+		if len(values) >= 1 {
+			labels[labelName] = values[len(values)-1]
+		}
+	default:
+		labels[labelName] = ""
+		if len(values) >= 1 {
+			labels[labelName] = values[0]
+		}
+	}
+
+	return labels
+}
+
+// sanitizeLabelValue applies the handling of invalid UTF-8 values and the maximum length of
+// label values.  The returned boolean is false when the label must be dropped.
+func sanitizeLabelValue(value string, invalidUTF8 string, maxLength int) (string, bool) {
+	if !utf8.ValidString(value) {
+		switch invalidUTF8 {
+		case config.InvalidUTF8Drop:
+			return "", false
+		case config.InvalidUTF8Hex:
+			value = hex.EncodeToString([]byte(value))
+		default:
+			value = strings.ToValidUTF8(value, "\uFFFD")
+		}
+	}
+
+	if maxLength > 0 && utf8.RuneCountInString(value) > maxLength {
+		// Truncate on a rune boundary so that the value remains valid UTF-8
+		runes := 0
+		for i := range value {
+			if runes == maxLength {
+				value = value[:i]
+				break
+			}
+			runes++
+		}
+	}
+	return value, true
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+func TestAttributeLabels(t *testing.T) {
+
+	values := []string{"CN=Group A,DC=example,DC=org", "CN=Group B,DC=example,DC=org"}
+
+	tests := []struct {
+		opts     *config.AttributeOptions
+		values   []string
+		expected map[string]string
+	}{
+		{nil, values, map[string]string{"__meta_ldap_member_of": values[0]}},
+		{nil, []string{}, map[string]string{"__meta_ldap_member_of": ""}},
+		{&config.AttributeOptions{MultiValue: "last"}, values, map[string]string{"__meta_ldap_member_of": values[1]}},
+		{&config.AttributeOptions{MultiValue: "join", Separator: ";"}, values, map[string]string{"__meta_ldap_member_of": values[0] + ";" + values[1]}},
+		{&config.AttributeOptions{MultiValue: "join", Separator: ";", Enclose: true}, values, map[string]string{"__meta_ldap_member_of": ";" + values[0] + ";" + values[1] + ";"}},
+		{&config.AttributeOptions{MultiValue: "join", Separator: ";", Enclose: true}, []string{}, map[string]string{"__meta_ldap_member_of": ""}},
+		{&config.AttributeOptions{MultiValue: "index"}, values, map[string]string{"__meta_ldap_member_of_0": values[0], "__meta_ldap_member_of_1": values[1]}},
+	}
+
+	for i, test := range tests {
+		if test.opts != nil {
+			if err := test.opts.Validate("memberOf"); err != nil {
+				t.Fatalf("Test %d: unexpected error: %s", i, err)
+			}
+		}
+		res := attributeLabels("memberOf", test.values, test.opts, config.DecodeNone)
+		if !reflect.DeepEqual(res, test.expected) {
+			t.Errorf("Test %d: expecting %v, got %v", i, test.expected, res)
+		}
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+
+	invalid := string([]byte{'a', 0xff, 'b'})
+
+	tests := []struct {
+		value       string
+		invalidUTF8 string
+		maxLength   int
+		expected    string
+		keep        bool
+	}{
+		{"description", "replace", 0, "description", true},
+		{"description", "replace", 4, "desc", true},
+		{"héhé", "replace", 3, "héh", true},
+		{invalid, "replace", 0, "a�b", true},
+		{invalid, "hex", 0, "61ff62", true},
+		{invalid, "drop", 0, "", false},
+	}
+
+	for i, test := range tests {
+		res, keep := sanitizeLabelValue(test.value, test.invalidUTF8, test.maxLength)
+		if res != test.expected || keep != test.keep {
+			t.Errorf("Test %d: expecting (%q, %v), got (%q, %v)", i, test.expected, test.keep, res, keep)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"strings"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/metrics"
+	"go.uber.org/zap"
+)
+
+// mergeLabels merges the labels of a duplicate into the labels of the first occurrence,
+// according to the label conflict policy
+func mergeLabels(first, duplicate map[string]string, policy string) map[string]string {
+	merged := make(map[string]string, len(first))
+	for k, v := range first {
+		merged[k] = v
+	}
+	for k, v := range duplicate {
+		existing, ok := merged[k]
+		switch {
+		case !ok:
+			merged[k] = v
+		case existing == v:
+		case policy == config.ConflictLast:
+			merged[k] = v
+		case policy == config.ConflictDrop:
+			delete(merged, k)
+		}
+	}
+	return merged
+}
+
+// mergeAttributes merges the attributes of a duplicate object into the attributes of the first
+// occurrence, according to the label conflict policy.  The values of an attribute are compared
+// as a whole.
+func mergeAttributes(first, duplicate map[string][]string, policy string) map[string][]string {
+	joined := func(attributes map[string][]string) map[string]string {
+		res := make(map[string]string, len(attributes))
+		for k, v := range attributes {
+			res[k] = strings.Join(v, "\xff")
+		}
+		return res
+	}
+
+	merged := map[string][]string{}
+	for k, v := range mergeLabels(joined(first), joined(duplicate), policy) {
+		if v == strings.Join(first[k], "\xff") {
+			merged[k] = first[k]
+		} else {
+			merged[k] = duplicate[k]
+		}
+	}
+	return merged
+}
+
+// objectKey returns the key identifying duplicates of the object, or "" if it can't be identified
+func objectKey(obj LdapObject, key string) string {
+	switch key {
+	case config.DedupKeyDN:
+		return strings.ToLower(obj.DN)
+	case config.DedupKeyObjectGUID:
+		return obj.Attribute("objectGUID")
+	}
+	return ""
+}
+
+// deduplicateObjects removes the objects discovered more than once, such as when base DNs
+// overlap or several filters match the same object
+func (s *LdapStore) deduplicateObjects(targetGroup string, objects []LdapObject) []LdapObject {
+	dedup := s.baseDnMapping(targetGroup).Deduplicate
+	if dedup.Key != config.DedupKeyDN && dedup.Key != config.DedupKeyObjectGUID {
+		return objects
+	}
+
+	unique := []LdapObject{}
+	index := map[string]int{}
+	for _, obj := range objects {
+		key := objectKey(obj, dedup.Key)
+		i, ok := index[key]
+		if key == "" || !ok {
+			if key != "" {
+				index[key] = len(unique)
+			}
+			unique = append(unique, obj)
+			continue
+		}
+
+		logger.Logger.Debug("Removing duplicated object",
+			zap.String("target_group", targetGroup),
+			zap.String("dn", obj.DN))
+		unique[i].Attributes = mergeAttributes(unique[i].Attributes, obj.Attributes, dedup.LabelConflicts)
+	}
+
+	metrics.MetricGroupDuplicatesRemoved.WithLabelValues(targetGroup).Set(float64(len(objects) - len(unique)))
+	return unique
+}
+
+// deduplicateTargetGroups removes the target groups sharing the same target address, merging
+// their labels according to the label conflict policy.  The number of removed duplicates is
+// returned along with the deduplicated list.
+func deduplicateTargetGroups(tgList []TargetGroup, policy string) ([]TargetGroup, int) {
+	unique := []TargetGroup{}
+	index := map[string]int{}
+	for _, tg := range tgList {
+		key := strings.Join(tg.Targets, ",")
+		if i, ok := index[key]; ok {
+			unique[i].Labels = mergeLabels(unique[i].Labels, tg.Labels, policy)
+			continue
+		}
+		index[key] = len(unique)
+		unique = append(unique, tg)
+	}
+	return unique, len(tgList) - len(unique)
+}
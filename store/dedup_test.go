@@ -0,0 +1,65 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+func TestMergeLabels(t *testing.T) {
+
+	first := map[string]string{"a": "1", "b": "2", "c": "3"}
+	duplicate := map[string]string{"a": "1", "b": "20", "d": "4"}
+
+	tests := map[string]map[string]string{
+		"first": {"a": "1", "b": "2", "c": "3", "d": "4"},
+		"last":  {"a": "1", "b": "20", "c": "3", "d": "4"},
+		"drop":  {"a": "1", "c": "3", "d": "4"},
+	}
+	for policy, expected := range tests {
+		if res := mergeLabels(first, duplicate, policy); !reflect.DeepEqual(res, expected) {
+			t.Errorf("Policy %s: expecting %v, got %v", policy, expected, res)
+		}
+	}
+}
+
+func TestDeduplicateObjects(t *testing.T) {
+
+	s := newTestStore(t, &config.BaseDnMapping{
+		BaseDnList:   []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}, {DN: "OU=Datacenter 1,OU=Servers,DC=example,DC=org"}},
+		ExporterPort: 9182,
+		Deduplicate:  &config.Deduplication{LabelConflicts: "last"},
+	})
+
+	objects := []LdapObject{
+		{DN: "CN=HOST01,OU=Datacenter 1,OU=Servers,DC=example,DC=org", Hostname: "host01", Attributes: map[string][]string{"location": {"mtl"}}},
+		{DN: "CN=HOST02,OU=Servers,DC=example,DC=org", Hostname: "host02", Attributes: map[string][]string{}},
+		{DN: "cn=host01,ou=datacenter 1,ou=servers,dc=example,dc=org", Hostname: "host01", Attributes: map[string][]string{"location": {"tor"}}},
+	}
+
+	res := s.deduplicateObjects("test", objects)
+	if len(res) != 2 || res[0].Hostname != "host01" || res[1].Hostname != "host02" {
+		t.Fatalf("Unexpected deduplicated objects %+v", res)
+	}
+	if res[0].Attribute("location") != "tor" {
+		t.Errorf("Expecting the last location value to be kept, got %q", res[0].Attribute("location"))
+	}
+}
+
+func TestDeduplicateTargetGroups(t *testing.T) {
+
+	tgList := []TargetGroup{
+		{Targets: []string{"host01:9182"}, Labels: map[string]string{"a": "1"}},
+		{Targets: []string{"host02:9182"}, Labels: map[string]string{"a": "2"}},
+		{Targets: []string{"host01:9182"}, Labels: map[string]string{"a": "3"}},
+	}
+	res, removed := deduplicateTargetGroups(tgList, "first")
+	expected := []TargetGroup{
+		{Targets: []string{"host01:9182"}, Labels: map[string]string{"a": "1"}},
+		{Targets: []string{"host02:9182"}, Labels: map[string]string{"a": "2"}},
+	}
+	if removed != 1 || !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expecting %+v with 1 duplicate removed, got %+v with %d removed", expected, res, removed)
+	}
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+// dnComponents holds the OUs, from the top-level one down to the parent of the object, and
+// the domain name of a DN or canonical name
+type dnComponents struct {
+	ous    []string
+	domain string
+}
+
+// parseDN extracts the OUs and domain components from a distinguished name such as
+// CN=HOST01,OU=Computers,OU=Office 1,DC=example,DC=org
+func parseDN(value string) (*dnComponents, error) {
+	dn, err := ldap.ParseDN(value)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &dnComponents{ous: []string{}}
+	dcs := []string{}
+	// RDNs are ordered from the object up to the root, so they are walked in reverse
+	for i := len(dn.RDNs) - 1; i >= 0; i-- {
+		for _, attr := range dn.RDNs[i].Attributes {
+			switch strings.ToUpper(attr.Type) {
+			case "OU":
+				c.ous = append(c.ous, attr.Value)
+			case "DC":
+				dcs = append([]string{attr.Value}, dcs...)
+			}
+		}
+	}
+	c.domain = strings.Join(dcs, ".")
+	return c, nil
+}
+
+// parseCanonicalName extracts the OUs and domain from a canonical name such as
+// example.org/Office 1/Computers/HOST01.  All the containers between the domain and the
+// object are considered as OUs as the canonical name doesn't distinguish them.
+func parseCanonicalName(value string) (*dnComponents, error) {
+	parts := []string{}
+	var b strings.Builder
+	escaping := false
+	for _, r := range value {
+		switch {
+		case escaping:
+			b.WriteRune(r)
+			escaping = false
+		case r == '\\':
+			escaping = true
+		case r == '/':
+			parts = append(parts, b.String())
+			b.Reset()
+		default:
+			b.WriteRune(r)
+		}
+	}
+	parts = append(parts, b.String())
+
+	if len(parts) < 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid canonical name %q", value)
+	}
+	return &dnComponents{
+		domain: parts[0],
+		ous:    append([]string{}, parts[1:len(parts)-1]...),
+	}, nil
+}
+
+// dnLabels returns the labels extracted from the DN or canonical name value of an attribute
+func dnLabels(name, value string, opts *config.AttributeOptions) (map[string]string, error) {
+	labels := map[string]string{}
+	if opts == nil || len(opts.DnLabels) == 0 || value == "" {
+		return labels, nil
+	}
+
+	var c *dnComponents
+	var err error
+	if opts.DnFormat == config.DnFormatCanonical {
+		c, err = parseCanonicalName(value)
+	} else {
+		c, err = parseDN(value)
+	}
+	if err != nil {
+		return labels, err
+	}
+
+	for _, l := range opts.DnLabels {
+		value := ""
+		switch l.Type {
+		case config.DnLabelParentOu:
+			if len(c.ous) >= 1 {
+				value = c.ous[len(c.ous)-1]
+			}
+		case config.DnLabelOuPath:
+			value = strings.Join(c.ous, l.Separator)
+		case config.DnLabelOu:
+			index := l.Index
+			if index < 0 {
+				index = len(c.ous) + index
+			}
+			if index >= 0 && index < len(c.ous) {
+				value = c.ous[index]
+			}
+		case config.DnLabelDomain:
+			value = c.domain
+		}
+		labels[metaLabelPrefix+l.LabelName(name)] = value
+	}
+
+	return labels, nil
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+func TestDnLabels(t *testing.T) {
+
+	dnLabelConfigs := []*config.DnLabel{
+		{Type: "parent_ou"},
+		{Type: "ou_path"},
+		{Type: "domain"},
+		{Type: "ou", Index: 0, Name: "site"},
+		{Type: "ou", Index: -2, Name: "grand_parent_ou"},
+		{Type: "ou", Index: 5},
+	}
+
+	opts := &config.AttributeOptions{DnLabels: dnLabelConfigs}
+	if err := opts.Validate("distinguishedName"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := map[string]string{
+		"__meta_ldap_distinguished_name_parent_ou": "Computers",
+		"__meta_ldap_distinguished_name_ou_path":   "Office 1/Floor, 2/Computers",
+		"__meta_ldap_distinguished_name_domain":    "example.org",
+		"__meta_ldap_site":                         "Office 1",
+		"__meta_ldap_grand_parent_ou":              "Floor, 2",
+		"__meta_ldap_distinguished_name_ou_5":      "",
+	}
+
+	res, err := dnLabels("distinguishedName", "CN=HOST01,OU=Computers,OU=Floor\\, 2,OU=Office 1,DC=example,DC=org", opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expecting %v, got %v", expected, res)
+	}
+
+	opts = &config.AttributeOptions{DnLabels: dnLabelConfigs}
+	if err := opts.Validate("canonicalName"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected = map[string]string{
+		"__meta_ldap_canonical_name_parent_ou": "Computers",
+		"__meta_ldap_canonical_name_ou_path":   "Office 1/Floor, 2/Computers",
+		"__meta_ldap_canonical_name_domain":    "example.org",
+		"__meta_ldap_site":                     "Office 1",
+		"__meta_ldap_grand_parent_ou":          "Floor, 2",
+		"__meta_ldap_canonical_name_ou_5":      "",
+	}
+	res, err = dnLabels("canonicalName", "example.org/Office 1/Floor, 2/Computers/HOST01", opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expecting %v, got %v", expected, res)
+	}
+
+	if _, err := dnLabels("distinguishedName", "not a dn", &config.AttributeOptions{DnFormat: "dn", DnLabels: dnLabelConfigs}); err == nil {
+		t.Errorf("Expecting error for invalid DN")
+	}
+}
@@ -11,6 +11,8 @@ const (
 	LdapStoreErrorCache              = 4
 	LdapStoreErrorCacheUpdate        = 5
 	LdapStoreErrorCacheFetch         = 6
+	LdapStoreErrorGuardrail          = 7
+	LdapStoreErrorPartialFailure     = 8
 )
 
 // LDAPStoreErrorCodeMap contains string descriptions for LDAP error codes
@@ -22,6 +24,8 @@ var LDAPStoreErrorCodeMap = map[uint16]string{
 	LdapStoreErrorCache:              "A general cache error was encountered",
 	LdapStoreErrorCacheUpdate:        "The cache update operation failed",
 	LdapStoreErrorCacheFetch:         "The cache fetch operation failed",
+	LdapStoreErrorGuardrail:          "The discovered objects were rejected by the target group guardrails",
+	LdapStoreErrorPartialFailure:     "The search of some of the target group base DNs failed",
 }
 
 // Error holds LdapStore error information
@@ -89,4 +89,26 @@ func TestErrors(t *testing.T) {
 		}
 	}
 
+	errCode = 7
+	errs = []error{
+		&Error{Code: LdapStoreErrorGuardrail},
+		&Error{Code: uint16(errCode)},
+	}
+	for _, err := range errs {
+		if err.Error() != genErrorMsg("The discovered objects were rejected by the target group guardrails", errCode) {
+			t.Errorf("Expecting error: %q, wanted %q", err.Error(), LDAPStoreErrorCodeMap[LdapStoreErrorGuardrail])
+		}
+	}
+
+	errCode = 8
+	errs = []error{
+		&Error{Code: LdapStoreErrorPartialFailure},
+		&Error{Code: uint16(errCode)},
+	}
+	for _, err := range errs {
+		if err.Error() != genErrorMsg("The search of some of the target group base DNs failed", errCode) {
+			t.Errorf("Expecting error: %q, wanted %q", err.Error(), LDAPStoreErrorCodeMap[LdapStoreErrorPartialFailure])
+		}
+	}
+
 }
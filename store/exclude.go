@@ -0,0 +1,79 @@
+package store
+
+import (
+	"time"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/metrics"
+	"go.uber.org/zap"
+)
+
+// Reasons for which discovered objects are excluded from a target group
+const (
+	ExcludeReasonDisabled   = "disabled"
+	ExcludeReasonStale      = "stale"
+	ExcludeReasonNoHostname = "no_hostname"
+	ExcludeReasonUnresolved = "unresolved"
+)
+
+// nowFunc returns the current time, and can be replaced in tests
+var nowFunc = time.Now
+
+// isDisabled returns true if the account disabled flag of the object's userAccountControl is set
+func isDisabled(obj LdapObject) bool {
+	uac, err := parseUAC(obj.Attribute("userAccountControl"))
+	if err != nil {
+		return false
+	}
+	return uac&uacAccountDisable != 0
+}
+
+// isStale returns true if the most recent of the given FILETIME attributes is older than
+// maxAge.  Objects without any of the attributes set are never considered stale.
+func isStale(obj LdapObject, attributes []string, maxAge time.Duration) bool {
+	var lastActivity time.Time
+	for _, attrib := range attributes {
+		t, set, err := parseFiletime(obj.Attribute(attrib))
+		if err != nil || !set {
+			continue
+		}
+		if t.After(lastActivity) {
+			lastActivity = t
+		}
+	}
+	if lastActivity.IsZero() {
+		return false
+	}
+	return nowFunc().Sub(lastActivity) > maxAge
+}
+
+// excludeObjects removes the disabled and stale objects from the discovered objects, according
+// to the configuration of the target group
+func (s *LdapStore) excludeObjects(targetGroup string, objects []LdapObject) []LdapObject {
+	baseDnMapping := s.baseDnMapping(targetGroup)
+	if !baseDnMapping.ExcludeDisabled && baseDnMapping.ExcludeStale == nil {
+		return objects
+	}
+
+	kept := []LdapObject{}
+	for _, obj := range objects {
+		reason := ""
+		if baseDnMapping.ExcludeDisabled && isDisabled(obj) {
+			reason = ExcludeReasonDisabled
+		} else if baseDnMapping.ExcludeStale != nil &&
+			isStale(obj, baseDnMapping.ExcludeStale.Attributes, time.Duration(baseDnMapping.ExcludeStale.MaxAge)) {
+			reason = ExcludeReasonStale
+		}
+
+		if reason != "" {
+			logger.Logger.Debug("Excluding object from target group",
+				zap.String("target_group", targetGroup),
+				zap.String("name", obj.Hostname),
+				zap.String("reason", reason))
+			metrics.MetricGroupExcludedObjects.WithLabelValues(targetGroup, reason).Inc()
+			continue
+		}
+		kept = append(kept, obj)
+	}
+	return kept
+}
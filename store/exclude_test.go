@@ -0,0 +1,46 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+	"github.com/prometheus/common/model"
+)
+
+func TestExcludeObjects(t *testing.T) {
+
+	nowFunc = func() time.Time { return time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC) }
+	defer func() { nowFunc = time.Now }()
+
+	s := newTestStore(t, &config.BaseDnMapping{
+		BaseDnList:      []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+		ExporterPort:    9182,
+		ExcludeDisabled: true,
+		ExcludeStale:    &config.StaleFilter{MaxAge: model.Duration(30 * 24 * time.Hour)},
+	})
+
+	objects := []LdapObject{
+		// Enabled, logged on 2021-03-22
+		{Hostname: "active", Attributes: map[string][]string{"userAccountControl": {"4096"}, "lastLogonTimestamp": {"132608448000000000"}}},
+		// Disabled
+		{Hostname: "disabled", Attributes: map[string][]string{"userAccountControl": {"4098"}, "lastLogonTimestamp": {"132608448000000000"}}},
+		// Logged on 2021-01-01, but password changed 2021-03-22
+		{Hostname: "password", Attributes: map[string][]string{"userAccountControl": {"4096"}, "lastLogonTimestamp": {"132539328000000000"}, "pwdLastSet": {"132608448000000000"}}},
+		// Logged on 2021-01-01
+		{Hostname: "stale", Attributes: map[string][]string{"userAccountControl": {"4096"}, "lastLogonTimestamp": {"132539328000000000"}}},
+		// Never logged on
+		{Hostname: "never", Attributes: map[string][]string{"userAccountControl": {"4096"}, "lastLogonTimestamp": {"0"}}},
+	}
+
+	res := s.excludeObjects("test", objects)
+	expected := []string{"active", "password", "never"}
+	if len(res) != len(expected) {
+		t.Fatalf("Expecting %d objects, got %d", len(expected), len(res))
+	}
+	for i, obj := range res {
+		if obj.Hostname != expected[i] {
+			t.Errorf("Expecting object %s, got %s", expected[i], obj.Hostname)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package store
+
+import (
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"go.uber.org/zap"
+)
+
+// searchConn returns the connection used for the searches of a target group: the connection to its
+// Global Catalog server when it searches the Global Catalog, the configured server connection otherwise
+func (s *LdapStore) searchConn(m *config.BaseDnMapping) (ldap.Client, error) {
+	if m == nil || m.GlobalCatalog == nil {
+		return s.connection()
+	}
+	return s.globalCatalogConn(m.GlobalCatalog.URL())
+}
+
+// globalCatalogConn returns the connection to the Global Catalog server, dialing it when it isn't
+// connected yet or was closed
+func (s *LdapStore) globalCatalogConn(server string) (ldap.Client, error) {
+	s.gcLock.Lock()
+	defer s.gcLock.Unlock()
+
+	if conn, ok := s.gcConns[server]; ok && !conn.IsClosing() {
+		return conn, nil
+	}
+
+	logger.Logger.Debug("Dialing Global Catalog server", zap.String("server", server))
+	conn, err := serverDialer(s, server)
+	if err != nil {
+		return nil, err
+	}
+	if s.gcConns == nil {
+		s.gcConns = map[string]ldap.Client{}
+	}
+	s.gcConns[server] = conn
+	return conn, nil
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+func TestGlobalCatalogSearch(t *testing.T) {
+
+	gc := &referralDirectory{
+		results: map[string]*ldap.SearchResult{
+			"": {Entries: []*ldap.Entry{
+				ldap.NewEntry("CN=host01,OU=Servers,DC=example,DC=org", map[string][]string{"name": {"host01"}, "dNSHostName": {"host01.example.org"}}),
+				ldap.NewEntry("CN=host02,OU=Servers,DC=child,DC=example,DC=org", map[string][]string{"name": {"host02"}, "dNSHostName": {"host02.child.example.org"}}),
+			}},
+		},
+	}
+	dials := 0
+	dialer := serverDialer
+	defer func() { serverDialer = dialer }()
+	serverDialer = func(s *LdapStore, server string) (ldap.Client, error) {
+		if server != "ldap://gc.example.org:3268" {
+			return nil, errors.New("unknown server")
+		}
+		dials++
+		return gc, nil
+	}
+
+	s := newTestStore(t, &config.BaseDnMapping{
+		GlobalCatalog: &config.GlobalCatalog{Server: "gc.example.org:3268"},
+		ExporterPort:  9182,
+	})
+	s.conn = &referralDirectory{errors: map[string]error{"": errors.New("not a Global Catalog")}}
+
+	for i := 0; i < 2; i++ {
+		objects, err := s.getResults("test", &config.BaseDn{}, "(objectClass=computer)", []string{"name", "dNSHostName"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(objects) != 2 {
+			t.Errorf("Expecting 2 objects, got %d", len(objects))
+		}
+	}
+	if dials != 1 {
+		t.Errorf("Expecting the Global Catalog connection to be reused, got %d dials", dials)
+	}
+	if len(gc.searches) != 2 || gc.searches[0].Scope != ldap.ScopeWholeSubtree {
+		t.Errorf("Unexpected Global Catalog searches: %+v", gc.searches)
+	}
+}
+
+func TestGlobalCatalogChildOUs(t *testing.T) {
+
+	gc := &referralDirectory{
+		results: map[string]*ldap.SearchResult{
+			"OU=Sites,DC=example,DC=org": {Entries: []*ldap.Entry{
+				ldap.NewEntry("OU=Paris,OU=Sites,DC=example,DC=org", map[string][]string{"ou": {"Paris"}}),
+			}},
+		},
+	}
+	dialer := serverDialer
+	defer func() { serverDialer = dialer }()
+	serverDialer = func(s *LdapStore, server string) (ldap.Client, error) {
+		return gc, nil
+	}
+
+	mapping := &config.BaseDnMapping{
+		GlobalCatalog: &config.GlobalCatalog{Server: "gc.example.org:3268"},
+		ExporterPort:  9182,
+	}
+	s := newTestStore(t, mapping)
+	s.conn = &referralDirectory{errors: map[string]error{"OU=Sites,DC=example,DC=org": errors.New("not a Global Catalog")}}
+
+	// The child OUs of a group template are searched in the Global Catalog
+	dns, err := s.searchChildOUs(&config.GroupTemplate{ChildOUsOf: "OU=Sites,DC=example,DC=org", Mapping: mapping})
+	if err != nil || len(dns) != 1 || dns[0] != "OU=Paris,OU=Sites,DC=example,DC=org" {
+		t.Errorf("Expecting the child OU found in the Global Catalog, got %v (%v)", dns, err)
+	}
+}
+
+func TestReloadClosesGlobalCatalogConns(t *testing.T) {
+
+	newConfig := func(gcServer string) *config.LdapConfig {
+		c := &config.LdapConfig{
+			URL:               "ldap.example.org:389",
+			BindDN:            "CN=ro_user,DC=example,DC=org",
+			DefaultAttributes: []string{"operatingSystem"},
+			CacheDir:          t.TempDir(),
+			BaseDnMappings: map[string]*config.BaseDnMapping{
+				"forest": {GlobalCatalog: &config.GlobalCatalog{Server: gcServer}, ExporterPort: 9182},
+			},
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("Invalid configuration: %s", err)
+		}
+		return c
+	}
+
+	c := newConfig("gc1.example.org:3268")
+	s, err := NewLdapStoreFromConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Shutdown()
+	gc1, gc2 := &closingDirectory{}, &closingDirectory{}
+	s.gcConns = map[string]ldap.Client{"ldap://gc1.example.org:3268": gc1, "ldap://gc2.example.org:3268": gc2}
+
+	reloaded := newConfig("gc2.example.org:3268")
+	reloaded.CacheDir = c.CacheDir
+	if err := s.Reload(reloaded); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !gc1.closed || gc2.closed {
+		t.Errorf("Expecting only the connection to the removed server to be closed, got %t and %t", gc1.closed, gc2.closed)
+	}
+	if _, ok := s.gcConns["ldap://gc1.example.org:3268"]; ok || len(s.gcConns) != 1 {
+		t.Errorf("Unexpected Global Catalog connections: %v", s.gcConns)
+	}
+}
+
+// closingDirectory records whether the connection was closed
+type closingDirectory struct {
+	ldap.Client
+	closed bool
+}
+
+func (d *closingDirectory) Close() {
+	d.closed = true
+}
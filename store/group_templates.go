@@ -0,0 +1,230 @@
+package store
+
+import (
+	"sort"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/metrics"
+	"go.uber.org/zap"
+)
+
+const childOUFilter = "(objectClass=organizationalUnit)"
+
+// StartGroupTemplates generates the target groups of each group template and refreshes them
+// periodically until the store is shut down
+func (s *LdapStore) StartGroupTemplates() {
+	for name, tmpl := range s.Config.GroupTemplates {
+		go s.runGroupTemplate(name, tmpl, s.stop)
+	}
+}
+
+func (s *LdapStore) runGroupTemplate(name string, tmpl *config.GroupTemplate, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(tmpl.RefreshInterval))
+	defer ticker.Stop()
+
+	for {
+		if err := s.refreshGroupTemplate(name, tmpl); err != nil {
+			logger.Logger.Error("Could not refresh the target groups generated by the group template",
+				zap.String("template_name", name),
+				zap.String("error", err.Error()))
+			metrics.MetricGroupTemplateRefreshFailed.WithLabelValues(name).Inc()
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshGroupTemplate replaces the target groups generated by the group template with one group
+// per value or child OU currently found in LDAP.  The previous groups are kept on failure.  The
+// searches run against a snapshot of the configuration, and their results are dropped if a reload
+// changed or removed the template in the meantime.
+func (s *LdapStore) refreshGroupTemplate(name string, tmpl *config.GroupTemplate) error {
+	view := s.snapshot()
+	if view.Config.GroupTemplates[name] != tmpl {
+		return nil
+	}
+
+	if err := view.connect(); err != nil {
+		return err
+	}
+
+	var keys []string
+	var err error
+	if tmpl.ChildOUsOf != "" {
+		keys, err = view.searchChildOUs(tmpl)
+	} else {
+		keys, err = view.searchAttributeValues(tmpl)
+	}
+	if err != nil {
+		return err
+	}
+
+	groups := map[string]*config.BaseDnMapping{}
+	for _, key := range keys {
+		value, dn := key, ""
+		if tmpl.ChildOUsOf != "" {
+			value, dn = "", key
+		}
+		groupName, err := tmpl.RenderName(value, dn)
+		if err != nil || groupName == "" {
+			logger.Logger.Warn("Skipping generated target group with an empty or invalid name",
+				zap.String("template_name", name),
+				zap.String("value", key))
+			continue
+		}
+		if _, ok := view.Config.BaseDnMappings[groupName]; ok {
+			logger.Logger.Warn("Skipping generated target group which has the name of a configured target group",
+				zap.String("template_name", name),
+				zap.String("group_name", groupName))
+			continue
+		}
+		if _, ok := groups[groupName]; ok {
+			logger.Logger.Warn("Skipping generated target group which has the name of another generated group",
+				zap.String("template_name", name),
+				zap.String("group_name", groupName),
+				zap.String("value", key))
+			continue
+		}
+		mapping, err := tmpl.Generate(value, dn)
+		if err != nil {
+			logger.Logger.Warn("Skipping generated target group which has an invalid filter",
+				zap.String("template_name", name),
+				zap.String("group_name", groupName),
+				zap.String("error", err.Error()))
+			continue
+		}
+		groups[groupName] = mapping
+	}
+
+	// The lock is taken before mappingsLock, in the same order as the reloads
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	if s.Config.GroupTemplates[name] != tmpl {
+		logger.Logger.Debug("Dropping the target groups of the group template changed by a reload during the refresh",
+			zap.String("template_name", name))
+		return nil
+	}
+
+	s.mappingsLock.Lock()
+	if s.generatedMappings == nil {
+		s.generatedMappings = map[string]map[string]*config.BaseDnMapping{}
+	}
+	// A group generated by several templates belongs to the template with the lowest name, so that
+	// the same template wins whatever the order of the refreshes
+	for groupName := range groups {
+		for other, otherGroups := range s.generatedMappings {
+			if _, ok := otherGroups[groupName]; ok && other < name {
+				logger.Logger.Warn("Skipping generated target group which has the name of a group generated by another template",
+					zap.String("template_name", name),
+					zap.String("other_template_name", other),
+					zap.String("group_name", groupName))
+				delete(groups, groupName)
+				break
+			}
+		}
+	}
+	s.generatedMappings[name] = groups
+	s.mappingsLock.Unlock()
+
+	logger.Logger.Debug("Refreshed the target groups generated by the group template",
+		zap.String("template_name", name),
+		zap.Int("num_groups", len(groups)))
+	metrics.MetricGeneratedTargetGroups.WithLabelValues(name).Set(float64(len(groups)))
+	return nil
+}
+
+// GeneratedGroups returns the configuration of the target groups currently generated by the group
+// templates and served, by name
+func (s *LdapStore) GeneratedGroups() map[string]*config.BaseDnMapping {
+	view := s.snapshot()
+
+	view.mappingsLock.RLock()
+	names := []string{}
+	for _, groups := range view.generatedMappings {
+		for name := range groups {
+			names = append(names, name)
+		}
+	}
+	view.mappingsLock.RUnlock()
+
+	generated := map[string]*config.BaseDnMapping{}
+	for _, name := range names {
+		if _, ok := view.Config.BaseDnMappings[name]; ok {
+			continue
+		}
+		if m := view.baseDnMapping(name); m != nil {
+			generated[name] = m
+		}
+	}
+	return generated
+}
+
+// searchChildOUs returns the sorted DNs of the OUs directly below the child_ous_of DN of the template
+func (s *LdapStore) searchChildOUs(tmpl *config.GroupTemplate) ([]string, error) {
+	conn, err := s.searchConn(tmpl.Mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	search := ldap.NewSearchRequest(tmpl.ChildOUsOf, ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
+		childOUFilter, []string{"ou"}, nil)
+	res, err := conn.SearchWithPaging(search, searchPagingSize)
+	if err != nil {
+		return nil, err
+	}
+	dns := make([]string, 0, len(res.Entries))
+	for _, e := range res.Entries {
+		dns = append(dns, e.DN)
+	}
+	sort.Strings(dns)
+	return dns, nil
+}
+
+// searchAttributeValues returns the sorted distinct values of the template attribute among the
+// objects matching the base DNs and filter of the template mapping
+func (s *LdapStore) searchAttributeValues(tmpl *config.GroupTemplate) ([]string, error) {
+	baseDnList := tmpl.Mapping.BaseDnList
+	if len(baseDnList) == 0 {
+		baseDnList = []*config.BaseDn{{}}
+	}
+
+	conn, err := s.searchConn(tmpl.Mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, baseDn := range baseDnList {
+		baseDnFilter, err := s.Config.EffectiveFilter(tmpl.Mapping, baseDn)
+		if err != nil {
+			return nil, err
+		}
+		search := ldap.NewSearchRequest(baseDn.DN, baseDn.SearchScope(), baseDn.DerefPolicy(), 0, 0, false,
+			baseDnFilter.String(), []string{tmpl.Attribute}, nil)
+		res, err := conn.SearchWithPaging(search, searchPagingSize)
+		if err != nil {
+			return nil, err
+		}
+		if err := completeRangedAttributes(conn, res.Entries); err != nil {
+			return nil, err
+		}
+		for _, e := range res.Entries {
+			for _, v := range e.GetAttributeValues(tmpl.Attribute) {
+				seen[v] = true
+			}
+		}
+	}
+
+	values := make([]string, 0, len(seen))
+	for v := range seen {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values, nil
+}
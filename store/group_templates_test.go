@@ -0,0 +1,121 @@
+package store
+
+import (
+	"testing"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+func TestRefreshGroupTemplate(t *testing.T) {
+
+	dir := &fakeDirectory{
+		subtree: []*ldap.Entry{
+			ldap.NewEntry("OU=Montreal,OU=Sites,DC=example,DC=org", map[string][]string{"location": {"Montreal"}}),
+			ldap.NewEntry("OU=Toronto,OU=Sites,DC=example,DC=org", map[string][]string{"location": {"Toronto", "montreal"}}),
+		},
+	}
+
+	tmpl := &config.GroupTemplate{
+		Name:       "site-{{ .ou }}",
+		ChildOUsOf: "OU=Sites,DC=example,DC=org",
+		Mapping:    &config.BaseDnMapping{ExporterPort: 9182},
+	}
+	if err := tmpl.Validate("sites"); err != nil {
+		t.Fatalf("Invalid group template: %s", err)
+	}
+	byLocation := &config.GroupTemplate{
+		Name:      "{{ .value }}",
+		Attribute: "location",
+		Mapping:   &config.BaseDnMapping{BaseDnList: []*config.BaseDn{{DN: "DC=example,DC=org"}}, ExporterPort: 9182},
+	}
+	if err := byLocation.Validate("locations"); err != nil {
+		t.Fatalf("Invalid group template: %s", err)
+	}
+
+	s := newTestStore(t, &config.BaseDnMapping{BaseDnList: []*config.BaseDn{{DN: "DC=example,DC=org"}}, ExporterPort: 9182})
+	s.conn = dir
+	s.Config.GroupTemplates = map[string]*config.GroupTemplate{"sites": tmpl, "locations": byLocation}
+	// The generated group named like the configured group is skipped
+	s.Config.BaseDnMappings["Toronto"] = s.Config.BaseDnMappings["test"]
+
+	if err := s.refreshGroupTemplate("sites", tmpl); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := s.refreshGroupTemplate("locations", byLocation); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	m := s.baseDnMapping("site-Toronto")
+	if m == nil || len(m.BaseDnList) != 1 || m.BaseDnList[0].DN != "OU=Toronto,OU=Sites,DC=example,DC=org" {
+		t.Errorf("Expecting generated group for the Toronto OU, got %+v", m)
+	}
+	search := dir.searches[0]
+	if search.BaseDN != tmpl.ChildOUsOf || search.Scope != ldap.ScopeSingleLevel {
+		t.Errorf("Expecting single level search of the child OUs, got %+v", search)
+	}
+
+	m = s.baseDnMapping("montreal")
+	if m == nil || m.Filter != "(location=montreal)" {
+		t.Errorf("Expecting generated group with the attribute value filter, got %+v", m)
+	}
+	if s.baseDnMapping("Toronto") != s.Config.BaseDnMappings["test"] {
+		t.Errorf("Expecting the configured group to take precedence over the generated group")
+	}
+	if len(s.generatedMappings["locations"]) != 2 {
+		t.Errorf("Expecting 2 groups generated from the attribute values, got %d", len(s.generatedMappings["locations"]))
+	}
+	generated := s.GeneratedGroups()
+	if len(generated) != 4 || generated["site-Toronto"] != s.baseDnMapping("site-Toronto") || generated["Toronto"] != nil {
+		t.Errorf("Expecting the 4 served generated groups, got %v", generated)
+	}
+
+	// Groups which are no longer found are removed on refresh
+	dir.subtree = dir.subtree[:1]
+	if err := s.refreshGroupTemplate("sites", tmpl); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s.baseDnMapping("site-Toronto") != nil {
+		t.Errorf("Expecting generated group of the removed OU to be removed")
+	}
+}
+
+func TestRefreshGroupTemplateCollisions(t *testing.T) {
+
+	dir := &fakeDirectory{
+		subtree: []*ldap.Entry{ldap.NewEntry("OU=Montreal,OU=Sites,DC=example,DC=org", map[string][]string{"ou": {"Montreal"}})},
+	}
+	newTemplate := func(name string, port int) *config.GroupTemplate {
+		tmpl := &config.GroupTemplate{
+			Name:       "site-{{ .ou }}",
+			ChildOUsOf: "OU=Sites,DC=example,DC=org",
+			Mapping:    &config.BaseDnMapping{ExporterPort: port},
+		}
+		if err := tmpl.Validate(name); err != nil {
+			t.Fatalf("Invalid group template: %s", err)
+		}
+		return tmpl
+	}
+	first, second := newTemplate("a-sites", 9182), newTemplate("b-sites", 9100)
+
+	s := newTestStore(t, &config.BaseDnMapping{BaseDnList: []*config.BaseDn{{DN: "DC=example,DC=org"}}, ExporterPort: 9182})
+	s.conn = dir
+	s.Config.GroupTemplates = map[string]*config.GroupTemplate{"a-sites": first, "b-sites": second}
+
+	// The template with the lowest name wins whatever the order of the refreshes
+	refreshes := []struct {
+		name string
+		port int
+	}{{"b-sites", 9100}, {"a-sites", 9182}, {"b-sites", 9182}}
+	for _, r := range refreshes {
+		if err := s.refreshGroupTemplate(r.name, s.Config.GroupTemplates[r.name]); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if m := s.baseDnMapping("site-Montreal"); m == nil || m.ExporterPorts[0].Port != r.port {
+			t.Errorf("Expecting the group with port %d after refreshing %s, got %+v", r.port, r.name, m)
+		}
+	}
+	if len(s.generatedMappings["b-sites"]) != 0 {
+		t.Errorf("Expecting the colliding group to be skipped by the b-sites template, got %v", s.generatedMappings["b-sites"])
+	}
+}
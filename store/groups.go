@@ -0,0 +1,296 @@
+package store
+
+import (
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/filter"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	// matchingRuleInChain is the ActiveDirectory LDAP_MATCHING_RULE_IN_CHAIN which walks nested groups
+	matchingRuleInChain = "1.2.840.113556.1.4.1941"
+	// activeDirectoryOID is the capability advertised in the RootDSE by ActiveDirectory servers
+	activeDirectoryOID = "1.2.840.113556.1.4.800"
+)
+
+var (
+	// groupMemberAttributes are the attributes holding the members of a group
+	groupMemberAttributes = []string{"member", "uniqueMember"}
+	// groupObjectClasses are the object classes identifying a group in the recursive mode
+	groupObjectClasses = []string{"group", "groupOfNames", "groupOfUniqueNames"}
+)
+
+// isActiveDirectory detects whether the server is an ActiveDirectory domain controller from its RootDSE.
+// The detection is cached until the connection settings change, under the connection lock.
+func (s *LdapStore) isActiveDirectory() bool {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if s.activeDirectory != nil {
+		return *s.activeDirectory
+	}
+
+	// The connection may have been closed by a reload since the discovery connected
+	if err := s.connectLocked(); err != nil {
+		logger.Logger.Warn("Could not connect to read the RootDSE, assuming the server isn't ActiveDirectory",
+			zap.String("error", err.Error()))
+		return false
+	}
+
+	search := ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"supportedCapabilities"}, nil)
+	res, err := s.conn.Search(search)
+	if err != nil {
+		logger.Logger.Warn("Could not read the RootDSE, assuming the server isn't ActiveDirectory",
+			zap.String("error", err.Error()))
+		return false
+	}
+
+	isAD := false
+	for _, e := range res.Entries {
+		for _, capability := range e.GetAttributeValues("supportedCapabilities") {
+			if capability == activeDirectoryOID {
+				isAD = true
+			}
+		}
+	}
+	s.activeDirectory = &isAD
+	return isAD
+}
+
+// getGroupMembers returns the objects matching the filter which are direct or nested members of the
+// groups of the target group.  The objects of the last successful search of a group are returned
+// when its search fails.
+func (s *LdapStore) getGroupMembers(targetGroup string, mapping *config.BaseDnMapping, attributesList []string) ([]LdapObject, error) {
+	mode := mapping.GroupMembership.Mode
+	if mode == config.GroupModeAuto {
+		mode = config.GroupModeRecursive
+		if s.isActiveDirectory() {
+			mode = config.GroupModeInChain
+		}
+	}
+
+	var entries []LdapObject
+	failed := searchErrors{}
+	for _, group := range mapping.GroupMembership.Groups {
+		var res []LdapObject
+		var err error
+		if mode == config.GroupModeInChain {
+			res, err = s.getInChainMembers(targetGroup, group, mapping, attributesList)
+		} else {
+			res, err = s.getRecursiveMembers(targetGroup, group, mapping, attributesList)
+		}
+		if err != nil {
+			failed[group] = err
+		}
+		entries = append(entries, s.recordSearch(targetGroup, searchKey{dn: group}, res, err)...)
+	}
+	if len(failed) > 0 {
+		return entries, failed
+	}
+	return entries, nil
+}
+
+// getInChainMembers searches the nested members of a group with the LDAP_MATCHING_RULE_IN_CHAIN,
+// below the base DNs of the target group or the domain of the group if none are set
+func (s *LdapStore) getInChainMembers(targetGroup, group string, mapping *config.BaseDnMapping, attributesList []string) ([]LdapObject, error) {
+	baseDnList := mapping.BaseDnList
+	if len(baseDnList) == 0 {
+		baseDnList = []*config.BaseDn{{DN: domainRoot(group)}}
+	}
+
+	var entries []LdapObject
+	var resultsErr error
+	for _, baseDn := range baseDnList {
+		baseDnFilter, err := s.Config.EffectiveFilter(mapping, baseDn)
+		if err != nil {
+			resultsErr = err
+			continue
+		}
+		memberFilter := filter.Combine(
+			baseDnFilter,
+			filter.Extensible{Attr: "memberOf", MatchingRule: matchingRuleInChain, Value: ldap.EscapeFilter(group)},
+		)
+		res, err := s.getResults(targetGroup, baseDn, memberFilter.String(), attributesList)
+		if err != nil {
+			resultsErr = err
+		}
+		entries = append(entries, res...)
+	}
+	return entries, resultsErr
+}
+
+// memberFilter returns the filter of the base search of a group member, matching the groups and
+// the objects matching the effective filter of the base DNs containing the member
+func (s *LdapStore) memberFilter(dn string, mapping *config.BaseDnMapping) (filter.Filter, error) {
+	memberFilter := filter.Or{}
+	for _, class := range groupObjectClasses {
+		memberFilter = append(memberFilter, filter.Comparison{Attr: "objectClass", Op: "=", Value: class})
+	}
+	if len(mapping.BaseDnList) == 0 {
+		f, err := s.Config.EffectiveFilter(mapping, nil)
+		if err != nil {
+			return nil, err
+		}
+		return append(memberFilter, f), nil
+	}
+	for _, baseDn := range mapping.BaseDnList {
+		if baseDn.Contains(dn) {
+			f, err := s.Config.EffectiveFilter(mapping, baseDn)
+			if err != nil {
+				return nil, err
+			}
+			memberFilter = append(memberFilter, f)
+		}
+	}
+	return memberFilter, nil
+}
+
+// getRecursiveMembers walks the members of a group breadth first, following nested groups up to the
+// maximum depth.  Each member is read with a base search so that only the objects matching the filter
+// of the base DN containing them are returned, and the DNs already visited are skipped to break
+// membership cycles.
+func (s *LdapStore) getRecursiveMembers(targetGroup, group string, mapping *config.BaseDnMapping, attributesList []string) ([]LdapObject, error) {
+
+	conn, err := s.searchConn(mapping)
+	if err != nil {
+		return []LdapObject{}, err
+	}
+
+	searchAttributes := append(append([]string{}, attributesList...), "objectClass")
+	searchAttributes = append(searchAttributes, groupMemberAttributes...)
+
+	type member struct {
+		dn    string
+		depth int
+	}
+
+	var entries []*ldap.Entry
+	visited := map[string]bool{normalizeDN(group): true}
+	queue := []member{{dn: group, depth: 0}}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		memberFilter, err := s.memberFilter(current.dn, mapping)
+		if err != nil {
+			return []LdapObject{}, err
+		}
+		search := ldap.NewSearchRequest(current.dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			memberFilter.String(), searchAttributes, nil)
+		res, err := conn.Search(search)
+		if err != nil {
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+				logger.Logger.Warn("Skipping group member which doesn't exist",
+					zap.String("target_group", targetGroup),
+					zap.String("dn", current.dn))
+				continue
+			}
+			logger.Logger.Error("Could not read group member from LDAP",
+				zap.String("target_group", targetGroup),
+				zap.String("dn", current.dn),
+				zap.String("error", err.Error()))
+			return []LdapObject{}, err
+		}
+		if err := completeRangedAttributes(conn, res.Entries); err != nil {
+			logger.Logger.Error("Could not read the members of the group from LDAP",
+				zap.String("target_group", targetGroup),
+				zap.String("dn", current.dn),
+				zap.String("error", err.Error()))
+			return []LdapObject{}, err
+		}
+
+		for _, e := range res.Entries {
+			if !isGroup(e) {
+				if current.depth > 0 && isDescendant(e.DN, mapping.BaseDnList) {
+					entries = append(entries, e)
+				}
+				continue
+			}
+
+			if current.depth >= mapping.GroupMembership.MaxDepth {
+				logger.Logger.Warn("Not following nested group beyond the maximum depth",
+					zap.String("target_group", targetGroup),
+					zap.String("dn", e.DN),
+					zap.Int("max_depth", mapping.GroupMembership.MaxDepth))
+				continue
+			}
+			for _, attrib := range groupMemberAttributes {
+				for _, dn := range e.GetAttributeValues(attrib) {
+					if visited[normalizeDN(dn)] {
+						continue
+					}
+					visited[normalizeDN(dn)] = true
+					queue = append(queue, member{dn: dn, depth: current.depth + 1})
+				}
+			}
+		}
+	}
+
+	return s.buildObjects(targetGroup, group, entries, attributesList), nil
+}
+
+// isGroup returns true if the entry has one of the group object classes
+func isGroup(e *ldap.Entry) bool {
+	for _, class := range e.GetAttributeValues("objectClass") {
+		for _, groupClass := range groupObjectClasses {
+			if strings.EqualFold(class, groupClass) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isDescendant returns true if the DN is within the scope of one of the base DNs.  Any DN is
+// accepted when there are no base DNs.
+func isDescendant(dn string, baseDnList []*config.BaseDn) bool {
+	if len(baseDnList) == 0 {
+		return true
+	}
+	for _, baseDn := range baseDnList {
+		if baseDn.Contains(dn) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeDN returns a case insensitive representation of a DN used to detect already visited members
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	rdns := make([]string, 0, len(parsed.RDNs))
+	for _, rdn := range parsed.RDNs {
+		attrs := make([]string, 0, len(rdn.Attributes))
+		for _, a := range rdn.Attributes {
+			attrs = append(attrs, strings.ToLower(a.Type)+"="+strings.ToLower(a.Value))
+		}
+		rdns = append(rdns, strings.Join(attrs, "+"))
+	}
+	return strings.Join(rdns, ",")
+}
+
+// domainRoot returns the DN made of the domain components of a DN
+func domainRoot(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return ""
+	}
+	dcs := []string{}
+	for _, rdn := range parsed.RDNs {
+		for _, a := range rdn.Attributes {
+			if strings.EqualFold(a.Type, "dc") {
+				dcs = append(dcs, "DC="+a.Value)
+			}
+		}
+	}
+	return strings.Join(dcs, ",")
+}
@@ -0,0 +1,221 @@
+package store
+
+import (
+	"sort"
+	"testing"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+// fakeDirectory answers the searches from a static set of entries.  Base searches return the entry
+// if it's a group, a computer or has no object class, other searches return the canned subtree results.
+type fakeDirectory struct {
+	ldap.Client
+	entries  map[string]*ldap.Entry
+	subtree  []*ldap.Entry
+	searches []*ldap.SearchRequest
+}
+
+func (d *fakeDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	d.searches = append(d.searches, req)
+	if req.Scope != ldap.ScopeBaseObject {
+		return &ldap.SearchResult{Entries: d.subtree}, nil
+	}
+	e, ok := d.entries[normalizeDN(req.BaseDN)]
+	if !ok {
+		return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, nil)
+	}
+	classes := e.GetAttributeValues("objectClass")
+	for _, class := range classes {
+		if class == "computer" || isGroup(e) {
+			return &ldap.SearchResult{Entries: []*ldap.Entry{e}}, nil
+		}
+	}
+	if len(classes) == 0 {
+		return &ldap.SearchResult{Entries: []*ldap.Entry{e}}, nil
+	}
+	return &ldap.SearchResult{}, nil
+}
+
+func (d *fakeDirectory) IsClosing() bool {
+	return false
+}
+
+func (d *fakeDirectory) SearchWithPaging(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	return d.Search(req)
+}
+
+func (d *fakeDirectory) add(dn string, attributes map[string][]string) {
+	if d.entries == nil {
+		d.entries = map[string]*ldap.Entry{}
+	}
+	d.entries[normalizeDN(dn)] = ldap.NewEntry(dn, attributes)
+}
+
+func TestGetRecursiveMembers(t *testing.T) {
+
+	dir := &fakeDirectory{}
+	dir.add("CN=Monitored,OU=Groups,DC=example,DC=org", map[string][]string{
+		"objectClass": {"top", "group"},
+		"member": {
+			"CN=host01,OU=Servers,DC=example,DC=org",
+			"CN=Nested,OU=Groups,DC=example,DC=org",
+			"CN=jdoe,OU=Users,DC=example,DC=org",
+			"CN=deleted,OU=Servers,DC=example,DC=org",
+		},
+	})
+	// The nested groups reference each other and the first group to form a cycle
+	dir.add("CN=Nested,OU=Groups,DC=example,DC=org", map[string][]string{
+		"objectClass": {"top", "group"},
+		"member": {
+			"cn=host01,ou=servers,dc=example,dc=org",
+			"CN=host02,OU=Servers,DC=example,DC=org",
+			"CN=Deeper,OU=Groups,DC=example,DC=org",
+		},
+	})
+	dir.add("CN=Deeper,OU=Groups,DC=example,DC=org", map[string][]string{
+		"objectClass": {"top", "group"},
+		"member": {
+			"CN=Monitored,OU=Groups,DC=example,DC=org",
+			"CN=host03,OU=Workstations,DC=example,DC=org",
+		},
+	})
+	for _, dn := range []string{
+		"CN=host01,OU=Servers,DC=example,DC=org",
+		"CN=host02,OU=Servers,DC=example,DC=org",
+		"CN=host03,OU=Workstations,DC=example,DC=org",
+	} {
+		dir.add(dn, map[string][]string{
+			"objectClass": {"top", "computer"},
+			"name":        {dn[3:9]},
+			"dNSHostName": {dn[3:9] + ".example.org"},
+		})
+	}
+	dir.add("CN=jdoe,OU=Users,DC=example,DC=org", map[string][]string{"objectClass": {"top", "user"}})
+
+	tests := []struct {
+		mapping  *config.BaseDnMapping
+		expected []string
+	}{
+		{
+			mapping: &config.BaseDnMapping{
+				Filter:          "(objectClass=computer)",
+				ExporterPort:    9182,
+				GroupMembership: &config.GroupMembership{Groups: []string{"CN=Monitored,OU=Groups,DC=example,DC=org"}, Mode: config.GroupModeRecursive},
+			},
+			expected: []string{"host01.example.org", "host02.example.org", "host03.example.org"},
+		},
+		{
+			mapping: &config.BaseDnMapping{
+				Filter:          "(objectClass=computer)",
+				ExporterPort:    9182,
+				GroupMembership: &config.GroupMembership{Groups: []string{"CN=Monitored,OU=Groups,DC=example,DC=org"}, Mode: config.GroupModeRecursive, MaxDepth: 1},
+			},
+			expected: []string{"host01.example.org"},
+		},
+		{
+			mapping: &config.BaseDnMapping{
+				BaseDnList:      []*config.BaseDn{{DN: "ou=Servers,dc=example,dc=org"}},
+				Filter:          "(objectClass=computer)",
+				ExporterPort:    9182,
+				GroupMembership: &config.GroupMembership{Groups: []string{"CN=Monitored,OU=Groups,DC=example,DC=org"}, Mode: config.GroupModeRecursive},
+			},
+			expected: []string{"host01.example.org", "host02.example.org"},
+		},
+	}
+
+	for i, test := range tests {
+		s := newTestStore(t, test.mapping)
+		s.conn = dir
+
+		objects, err := s.getGroupMembers("test", test.mapping, []string{"name", "dNSHostName"})
+		if err != nil {
+			t.Fatalf("Unexpected error for test %d: %s", i, err)
+		}
+		addresses := []string{}
+		for _, o := range objects {
+			addresses = append(addresses, o.Address)
+		}
+		sort.Strings(addresses)
+		if len(addresses) != len(test.expected) {
+			t.Errorf("Expecting members %v for test %d, got %v", test.expected, i, addresses)
+			continue
+		}
+		for j := range addresses {
+			if addresses[j] != test.expected[j] {
+				t.Errorf("Expecting members %v for test %d, got %v", test.expected, i, addresses)
+				break
+			}
+		}
+	}
+}
+
+func TestMemberFilter(t *testing.T) {
+
+	mapping := &config.BaseDnMapping{
+		BaseDnList: []*config.BaseDn{
+			{DN: "OU=Servers,DC=example,DC=org"},
+			{DN: "OU=Desktops,DC=example,DC=org", Filter: "(operatingSystem=Windows*)"},
+		},
+		Filter:          "(objectClass=computer)",
+		ExporterPort:    9182,
+		GroupMembership: &config.GroupMembership{Groups: []string{"CN=Monitored,OU=Groups,DC=example,DC=org"}},
+	}
+	s := newTestStore(t, mapping)
+
+	groups := "(objectClass=group)(objectClass=groupOfNames)(objectClass=groupOfUniqueNames)"
+	tests := map[string]string{
+		"CN=host01,OU=Servers,DC=example,DC=org":  "(|" + groups + "(objectClass=computer))",
+		"CN=desk01,OU=Desktops,DC=example,DC=org": "(|" + groups + "(operatingSystem=Windows*))",
+		"CN=Nested,OU=Groups,DC=example,DC=org":   "(|" + groups + ")",
+	}
+	for dn, expected := range tests {
+		f, err := s.memberFilter(dn, mapping)
+		if err != nil || f.String() != expected {
+			t.Errorf("Expecting filter %q for member %s, got %v (error %v)", expected, dn, f, err)
+		}
+	}
+
+	// An invalid filter fails the search rather than matching every member
+	mapping.BaseDnList[1].Filter = "(operatingSystem=Windows*"
+	if _, err := s.memberFilter("CN=desk01,OU=Desktops,DC=example,DC=org", mapping); err == nil {
+		t.Errorf("Expecting an invalid base DN filter to return an error")
+	}
+}
+
+func TestGetInChainMembers(t *testing.T) {
+
+	dir := &fakeDirectory{
+		entries: map[string]*ldap.Entry{
+			"": ldap.NewEntry("", map[string][]string{"supportedCapabilities": {activeDirectoryOID}}),
+		},
+		subtree: []*ldap.Entry{
+			ldap.NewEntry("CN=host01,OU=Servers,DC=example,DC=org", map[string][]string{"name": {"host01"}, "dNSHostName": {"host01.example.org"}}),
+		},
+	}
+	mapping := &config.BaseDnMapping{
+		Filter:          "(objectClass=computer)",
+		ExporterPort:    9182,
+		GroupMembership: &config.GroupMembership{Groups: []string{"CN=Web (prod),OU=Groups,DC=example,DC=org"}},
+	}
+	s := newTestStore(t, mapping)
+	s.conn = dir
+
+	objects, err := s.getGroupMembers("test", mapping, []string{"name", "dNSHostName"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(objects) != 1 || objects[0].Address != "host01.example.org" {
+		t.Errorf("Unexpected members %+v", objects)
+	}
+
+	search := dir.searches[len(dir.searches)-1]
+	if search.BaseDN != "DC=example,DC=org" {
+		t.Errorf("Expecting search below the domain of the group, got %q", search.BaseDN)
+	}
+	expectedFilter := `(&(objectClass=computer)(memberOf:1.2.840.113556.1.4.1941:=CN=Web \28prod\29,OU=Groups,DC=example,DC=org))`
+	if search.Filter != expectedFilter {
+		t.Errorf("Expecting filter %q, got %q", expectedFilter, search.Filter)
+	}
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"time"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/metrics"
+	"go.uber.org/zap"
+)
+
+// Guardrail rejection reasons
+const (
+	GuardrailShrink     = "shrink"
+	GuardrailMaxObjects = "max_objects"
+)
+
+// acceptedRefresh holds the objects of the last accepted refresh of a target group with guardrails
+type acceptedRefresh struct {
+	Objects  []LdapObject
+	Accepted time.Time
+}
+
+// checkGuardrails returns the reason for which the objects of a refresh are rejected, or "" if
+// they are accepted.  The shrink check only applies when there is a previous refresh.
+func checkGuardrails(g *config.Guardrails, previous []LdapObject, hasPrevious bool, current []LdapObject) string {
+	if g == nil {
+		return ""
+	}
+	if g.MaxObjects > 0 && len(current) > g.MaxObjects {
+		return GuardrailMaxObjects
+	}
+	if g.MaxShrinkPercent > 0 && hasPrevious && len(previous) > 0 && len(current) < len(previous) {
+		shrink := float64(len(previous)-len(current)) * 100 / float64(len(previous))
+		if shrink > g.MaxShrinkPercent {
+			return GuardrailShrink
+		}
+	}
+	return ""
+}
+
+// previousObjects returns the objects of the last accepted refresh of the target group, unless it's
+// older than the maximum age of the guardrails.  They are read from the disk cache when they aren't
+// in memory, such as after a restart.
+func (s *LdapStore) previousObjects(targetGroup string, g *config.Guardrails) ([]LdapObject, bool) {
+	previous, ok := s.snapshots[targetGroup]
+	if !ok {
+		s.cacheLock.Lock()
+		err := s.cache.Get(snapshotKey(targetGroup), &previous)
+		s.cacheLock.Unlock()
+		if err != nil {
+			return nil, false
+		}
+		if s.snapshots == nil {
+			s.snapshots = map[string]acceptedRefresh{}
+		}
+		s.snapshots[targetGroup] = previous
+	}
+
+	if age := nowFunc().Sub(previous.Accepted); age > time.Duration(g.MaxPreviousAge) {
+		logger.Logger.Info("Not comparing to the last accepted refresh of the target group as it's too old",
+			zap.String("target_group", targetGroup),
+			zap.Duration("age", age))
+		return nil, false
+	}
+	return previous.Objects, true
+}
+
+// saveSnapshot keeps the objects of an accepted refresh of the target group in memory and in the
+// disk cache, until they reach the maximum age of the guardrails
+func (s *LdapStore) saveSnapshot(targetGroup string, entries []LdapObject, g *config.Guardrails) {
+	accepted := acceptedRefresh{Objects: entries, Accepted: nowFunc()}
+	if s.snapshots == nil {
+		s.snapshots = map[string]acceptedRefresh{}
+	}
+	s.snapshots[targetGroup] = accepted
+
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+	if err := s.cache.Put(snapshotKey(targetGroup), accepted, time.Duration(g.MaxPreviousAge)); err != nil {
+		logger.Logger.Warn("Could not store the accepted objects of the target group in cache",
+			zap.String("target_group", targetGroup),
+			zap.String("error", err.Error()))
+	}
+}
+
+// applyGuardrails returns the objects to serve for the target group: the refreshed objects when
+// they pass the guardrails, or the objects of the last accepted refresh otherwise, in which case
+// rejected is true.  An error is returned when the objects are rejected and there is no previous
+// refresh.  The objects of an incomplete refresh, such as when its DNS resolution or probes were
+// interrupted, are checked but not kept as the last accepted refresh.
+func (s *LdapStore) applyGuardrails(targetGroup string, entries []LdapObject, complete bool) (objects []LdapObject, rejected bool, err error) {
+	// The objects discovered with a configuration replaced by a reload in the meantime aren't kept
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	s.snapshotLock.Lock()
+	defer s.snapshotLock.Unlock()
+
+	guardrails := s.baseDnMapping(targetGroup).Guardrails
+	var previous []LdapObject
+	var hasPrevious bool
+	if guardrails != nil {
+		previous, hasPrevious = s.previousObjects(targetGroup, guardrails)
+	}
+	reason := checkGuardrails(guardrails, previous, hasPrevious, entries)
+	if reason == "" {
+		// The objects of the groups without guardrails are never compared to
+		if complete && guardrails != nil && s.generation == s.reloads {
+			s.saveSnapshot(targetGroup, entries, guardrails)
+		}
+		metrics.MetricGroupGuardrailTriggered.WithLabelValues(targetGroup).Set(0)
+		return entries, false, nil
+	}
+
+	logger.Logger.Warn("Refreshed objects rejected by the target group guardrails",
+		zap.String("target_group", targetGroup),
+		zap.String("reason", reason),
+		zap.Int("num_objects", len(entries)),
+		zap.Int("previous_num_objects", len(previous)),
+		zap.Bool("has_previous", hasPrevious))
+	metrics.MetricGroupGuardrailRejections.WithLabelValues(targetGroup, reason).Inc()
+	metrics.MetricGroupGuardrailTriggered.WithLabelValues(targetGroup).Set(1)
+
+	if !hasPrevious {
+		return []LdapObject{}, true, &Error{Code: LdapStoreErrorGuardrail, Properties: map[string]string{"target_group": targetGroup, "reason": reason}}
+	}
+	return previous, true, nil
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gadelkareem/cachita"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+func testObjects(n int) []LdapObject {
+	objects := make([]LdapObject, 0, n)
+	for i := 0; i < n; i++ {
+		objects = append(objects, LdapObject{Hostname: fmt.Sprintf("host%d", i)})
+	}
+	return objects
+}
+
+func TestApplyGuardrails(t *testing.T) {
+
+	mapping := &config.BaseDnMapping{
+		BaseDnList:   []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+		ExporterPort: 9182,
+		Guardrails:   &config.Guardrails{MaxShrinkPercent: 50, MaxObjects: 10},
+	}
+	cacheDir := t.TempDir()
+	s := newTestStore(t, mapping)
+	cache, err := cachita.NewFileCache(cacheDir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Could not create cache: %s", err)
+	}
+	s.cache = cache
+
+	// Too many objects without a previous refresh
+	res, _, err := s.applyGuardrails("test", testObjects(11), true)
+	if err == nil || err.(*Error).Code != LdapStoreErrorGuardrail {
+		t.Fatalf("Expecting guardrail error, got %v", err)
+	}
+	if len(res) != 0 {
+		t.Errorf("Expecting no objects, got %d", len(res))
+	}
+
+	steps := []struct {
+		num      int
+		expected int
+		rejected bool
+	}{
+		{num: 8, expected: 8},
+		// Shrinks by 50%, accepted
+		{num: 4, expected: 4},
+		// Shrinks by 75%, the previous objects are kept
+		{num: 1, expected: 4, rejected: true},
+		// Too many objects, the previous objects are kept
+		{num: 11, expected: 4, rejected: true},
+		{num: 10, expected: 10},
+	}
+	for i, step := range steps {
+		res, rejected, err := s.applyGuardrails("test", testObjects(step.num), true)
+		if err != nil {
+			t.Fatalf("Unexpected error at step %d: %s", i, err)
+		}
+		if len(res) != step.expected || rejected != step.rejected {
+			t.Errorf("Expecting %d objects (rejected %t) at step %d, got %d (rejected %t)", step.expected, step.rejected, i, len(res), rejected)
+		}
+	}
+
+	// After a restart, the last accepted objects are read from the disk cache
+	restarted := newTestStore(t, mapping)
+	cache, err = cachita.NewFileCache(cacheDir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Could not create cache: %s", err)
+	}
+	restarted.cache = cache
+	res, rejected, err := restarted.applyGuardrails("test", testObjects(1), true)
+	if err != nil || !rejected || len(res) != 10 {
+		t.Errorf("Expecting the 10 objects of the last accepted refresh, got %d (rejected %t, error %v)", len(res), rejected, err)
+	}
+
+	// The last accepted objects are no longer compared to once older than the maximum age
+	nowFunc = func() time.Time { return time.Now().Add(25 * time.Hour) }
+	defer func() { nowFunc = time.Now }()
+	res, rejected, err = restarted.applyGuardrails("test", testObjects(1), true)
+	if err != nil || rejected || len(res) != 1 {
+		t.Errorf("Expecting the shrink to be accepted once the previous refresh expired, got %d (rejected %t, error %v)", len(res), rejected, err)
+	}
+	res, rejected, err = restarted.applyGuardrails("test", testObjects(0), true)
+	if err != nil || !rejected || len(res) != 1 {
+		t.Errorf("Expecting the refreshed objects to be compared to again, got %d (rejected %t, error %v)", len(res), rejected, err)
+	}
+}
+
+func TestApplyGuardrailsWithoutGuardrails(t *testing.T) {
+
+	s := newTestStore(t, &config.BaseDnMapping{
+		BaseDnList:   []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+		ExporterPort: 9182,
+	})
+	res, rejected, err := s.applyGuardrails("test", testObjects(3), true)
+	if err != nil || rejected || len(res) != 3 {
+		t.Errorf("Expecting the 3 objects to be accepted, got %d (rejected %t, error %v)", len(res), rejected, err)
+	}
+	if _, ok := s.snapshots["test"]; ok {
+		t.Errorf("Expecting the objects of a group without guardrails not to be kept")
+	}
+}
+
+func TestCheckGuardrails(t *testing.T) {
+
+	g := &config.Guardrails{MaxShrinkPercent: 20}
+	if reason := checkGuardrails(g, nil, false, testObjects(0)); reason != "" {
+		t.Errorf("Expecting first refresh to be accepted, got %q", reason)
+	}
+	if reason := checkGuardrails(g, testObjects(0), true, testObjects(0)); reason != "" {
+		t.Errorf("Expecting refresh of an empty group to be accepted, got %q", reason)
+	}
+	if reason := checkGuardrails(g, testObjects(10), true, testObjects(7)); reason != GuardrailShrink {
+		t.Errorf("Expecting %q, got %q", GuardrailShrink, reason)
+	}
+	if reason := checkGuardrails(nil, testObjects(10), true, testObjects(0)); reason != "" {
+		t.Errorf("Expecting refresh without guardrails to be accepted, got %q", reason)
+	}
+}
@@ -1,12 +1,11 @@
 package store
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"os"
-	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,29 +20,95 @@ import (
 
 var (
 	searchPagingSize uint32 = 100
-	matchFirstCap           = regexp.MustCompile("(.)([A-Z][a-z]+)")
-	matchAllCap             = regexp.MustCompile("([a-z0-9])([A-Z])")
 	baseAttributes          = []string{"name", "dNSHostName"}
 )
 
 const (
-	defaultLdapFilter    = "(&(objectClass=computer))"
+	// cacheFormatVersion must be incremented whenever the structure of LdapObject changes, so
+	// that cache entries written by previous versions are ignored rather than failing to decode
+	cacheFormatVersion   = 6
 	maxReconnectAttempts = 5
+	// retryCacheTTL bounds the time during which partial results, interrupted refreshes and the
+	// objects served in place of a rejected refresh are cached
+	retryCacheTTL     = 30 * time.Second
+	metaLabelPrefix   = "__meta_ldap_"
+	labelExporterPort = metaLabelPrefix + "exporter_port_name"
+	labelAddress      = "__address__"
+	labelDNSResolved  = metaLabelPrefix + "dns_resolved"
+	labelHostname     = metaLabelPrefix + "hostname"
+	labelReachable    = metaLabelPrefix + "exporter_reachable"
 )
 
 type LdapStore struct {
-	Config            *config.LdapConfig
-	conn              *ldap.Conn
+	Config *config.LdapConfig
+	// generation is the number of reloads when the configuration was loaded, compared to the current
+	// one so that the objects discovered with a replaced configuration aren't cached
+	generation int
+	*shared
+}
+
+// shared holds the connections, cache and state of the store, which are shared with the views of
+// the store on a snapshot of its configuration used by the discoveries
+type shared struct {
+	conn              ldap.Client
 	cache             cachita.Cache
 	ReconnectAttempts int
 	connLock          sync.Mutex
-	cacheLock         sync.Mutex
-	isReady           bool
+	// connConfig is the configuration used to connect and bind to the server, guarded by connLock, so
+	// that a discovery started before a reload doesn't reconnect with the previous settings
+	connConfig *config.LdapConfig
+	cacheLock  sync.Mutex
+	isReady    bool
+	// reloadLock is held for writing while the configuration is swapped by a reload, and for reading
+	// while a snapshot of the configuration is taken
+	reloadLock sync.RWMutex
+	// reloads is the number of reloads, guarded by reloadLock
+	reloads int
+	// generatedMappings holds the target groups generated by each group template
+	generatedMappings map[string]map[string]*config.BaseDnMapping
+	mappingsLock      sync.RWMutex
+	stop              chan struct{}
+	// snapshots holds the last accepted refresh of each target group with guardrails
+	snapshots    map[string]acceptedRefresh
+	snapshotLock sync.Mutex
+	// searches holds the outcome and objects of the last search of each base DN of each target group
+	searches   map[string]map[searchKey]*searchSnapshot
+	statusLock sync.Mutex
+	// gcConns holds the connections to the Global Catalog servers, by URL
+	gcConns map[string]ldap.Client
+	gcLock  sync.Mutex
+	// activeDirectory caches the detection of an ActiveDirectory server by the group membership auto
+	// mode, guarded by connLock
+	activeDirectory *bool
 }
 
+// LdapObject holds the name and attribute values of a discovered LDAP object
 type LdapObject struct {
-	Hostname   string
-	Attributes map[string]string
+	DN          string
+	Hostname    string
+	Address     string
+	IPAddress   string
+	DNSResolved bool
+	// Reachable holds the result of the exporter probe for each exporter port name
+	Reachable  map[string]bool
+	Attributes map[string][]string
+}
+
+// Attribute returns the first value of the named attribute, or "" if it has no value
+func (o LdapObject) Attribute(name string) string {
+	if values := o.Attributes[name]; len(values) >= 1 {
+		return values[0]
+	}
+	return ""
+}
+
+// firstValues returns the first value of each attribute of the object
+func (o LdapObject) firstValues() map[string]string {
+	values := make(map[string]string, len(o.Attributes))
+	for k := range o.Attributes {
+		values[k] = o.Attribute(k)
+	}
+	return values
 }
 
 type TargetGroup struct {
@@ -51,10 +116,32 @@ type TargetGroup struct {
 	Labels  map[string]string `json:"labels"`
 }
 
-func keyToSnakeCase(str string) string {
-	snake := matchFirstCap.ReplaceAllString(str, "${1}_${2}")
-	snake = matchAllCap.ReplaceAllString(snake, "${1}_${2}")
-	return strings.ToLower(snake)
+// baseDnMapping returns the configuration of a configured or generated target group, or nil if
+// the target group doesn't exist.  Configured target groups take precedence over generated ones,
+// and the groups generated by the template with the lowest name over the ones of other templates.
+func (s *LdapStore) baseDnMapping(targetGroup string) *config.BaseDnMapping {
+	if m, ok := s.Config.BaseDnMappings[targetGroup]; ok {
+		return m
+	}
+	s.mappingsLock.RLock()
+	defer s.mappingsLock.RUnlock()
+	var found *config.BaseDnMapping
+	owner := ""
+	for name, groups := range s.generatedMappings {
+		if m, ok := groups[targetGroup]; ok && (found == nil || name < owner) {
+			found, owner = m, name
+		}
+	}
+	return found
+}
+
+func cacheKey(targetGroup string) string {
+	return fmt.Sprintf("v%d/%s", cacheFormatVersion, targetGroup)
+}
+
+// snapshotKey returns the cache key of the objects of the last accepted refresh of the target group
+func snapshotKey(targetGroup string) string {
+	return fmt.Sprintf("v%d/snapshot/%s", cacheFormatVersion, targetGroup)
 }
 
 func isBaseAttribute(name string, baseAttributes []string) bool {
@@ -76,40 +163,75 @@ func NewLdapStore(
 	authenticated bool,
 	unsecured bool,
 	cacheDir string,
-	cacheTTL int) (*LdapStore, error) {
+	cacheTTL int,
+	labels map[string]string,
+	groupTemplates map[string]*config.GroupTemplate,
+	referrals *config.Referrals) (*LdapStore, error) {
+
+	return NewLdapStoreFromConfig(&config.LdapConfig{
+		URL:               url,
+		BindDN:            bindDN,
+		BaseDnMappings:    baseDnMappings,
+		GroupTemplates:    groupTemplates,
+		Filter:            filter,
+		DefaultAttributes: defaultAttributes,
+		PasswordEnvVar:    passEnvVar,
+		Authenticated:     authenticated,
+		Unsecured:         unsecured,
+		CacheDir:          cacheDir,
+		CacheTTL:          cacheTTL,
+		Labels:            labels,
+		Referrals:         referrals,
+	})
 
-	cache, err := cachita.NewFileCache(cacheDir, time.Duration(cacheTTL)*time.Second, 5*time.Minute)
+}
+
+// NewLdapStoreFromConfig creates a store from a validated configuration, which is kept as is so
+// that it can be compared to the configuration of a later reload
+func NewLdapStoreFromConfig(c *config.LdapConfig) (*LdapStore, error) {
+
+	cache, err := cachita.NewFileCache(c.CacheDir, time.Duration(c.CacheTTL)*time.Second, 5*time.Minute)
 	if err != nil {
 		panic(err)
 	}
+	c.MaxReconnectAttempts = maxReconnectAttempts
 
 	return &LdapStore{
-		conn:              nil,
-		ReconnectAttempts: 0,
-		Config: &config.LdapConfig{
-			URL:                  url,
-			BindDN:               bindDN,
-			BaseDnMappings:       baseDnMappings,
-			Filter:               filter,
-			DefaultAttributes:    defaultAttributes,
-			PasswordEnvVar:       passEnvVar,
-			Authenticated:        authenticated,
-			Unsecured:            unsecured,
-			CacheDir:             cacheDir,
-			CacheTTL:             cacheTTL,
-			MaxReconnectAttempts: maxReconnectAttempts,
+		Config: c,
+		shared: &shared{
+			conn:              nil,
+			ReconnectAttempts: 0,
+			connConfig:        c,
+			cache:             cache,
+			isReady:           false,
+			generatedMappings: map[string]map[string]*config.BaseDnMapping{},
+			stop:              make(chan struct{}),
 		},
-		cache:   cache,
-		isReady: false,
 	}, nil
 
 }
 
 func (s *LdapStore) connect() error {
+	_, err := s.connection()
+	return err
+}
 
+// connection returns the connection to the configured server, connecting again when it was closed,
+// such as by a reload or the shutdown, since the connection was last used
+func (s *LdapStore) connection() (ldap.Client, error) {
 	s.connLock.Lock()
 	defer s.connLock.Unlock()
 
+	if err := s.connectLocked(); err != nil {
+		return nil, err
+	}
+	return s.conn, nil
+}
+
+// connectLocked connects to the configured server when it isn't connected.  The connection lock
+// must be held.
+func (s *LdapStore) connectLocked() error {
+
 	if s.conn == nil || s.conn.IsClosing() {
 
 	Retry:
@@ -123,39 +245,30 @@ func (s *LdapStore) connect() error {
 			// if ldap.IsErrorWithCode(connErr, ldap.ErrorNetwork) {
 			// }
 
-			logger.Logger.Debug("Dialing LDAP host", zap.String("host", s.Config.URL))
-			l, err := ldap.DialURL(fmt.Sprintf("ldap://%s", s.Config.URL))
+			c := s.connConfig
+			logger.Logger.Debug("Dialing LDAP host", zap.String("host", c.URL))
+			l, err := ldap.DialURL(fmt.Sprintf("ldap://%s", c.URL))
 			if err != nil {
 				return fmt.Errorf("Could not connect to %v", err)
 			}
 			l.SetTimeout(5 * time.Second)
-			if s.Config.Unsecured {
+			if c.Unsecured {
 				err = l.StartTLS(&tls.Config{InsecureSkipVerify: true})
 				if err != nil {
 					return fmt.Errorf("Could not upgrade connection to TLS: %v", err)
 				}
 			}
-			if !s.Config.Authenticated {
-				err = l.UnauthenticatedBind(s.Config.BindDN)
-				if err != nil {
-					if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) ||
-						ldap.IsErrorWithCode(err, ldap.LDAPResultServerDown) ||
-						ldap.IsErrorWithCode(err, ldap.LDAPResultConnectError) {
-						goto Retry
-					}
-					return fmt.Errorf("Could not perform unauthenticated bind: %v", err)
+			err = bind(l, c)
+			if err != nil {
+				if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) ||
+					ldap.IsErrorWithCode(err, ldap.LDAPResultServerDown) ||
+					ldap.IsErrorWithCode(err, ldap.LDAPResultConnectError) {
+					goto Retry
 				}
-			} else {
-				err = l.Bind(s.Config.BindDN, os.Getenv(s.Config.PasswordEnvVar))
-				if err != nil {
-					if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) ||
-						ldap.IsErrorWithCode(err, ldap.LDAPResultServerDown) ||
-						ldap.IsErrorWithCode(err, ldap.LDAPResultConnectError) {
-						goto Retry
-					}
-					return fmt.Errorf("Could not perform authenticated bind: %v", err)
-
+				if !c.Authenticated {
+					return fmt.Errorf("Could not perform unauthenticated bind: %v", err)
 				}
+				return fmt.Errorf("Could not perform authenticated bind: %v", err)
 			}
 
 			logger.Logger.Debug("Connection restablished")
@@ -173,14 +286,47 @@ func (s *LdapStore) connect() error {
 	return nil
 }
 
-func (s *LdapStore) getResults(targetGroup, baseDn, filter string, attributesList []string) ([]LdapObject, error) {
-	var entries []LdapObject
-	var obj LdapObject
+// bind binds the connection with the credentials of the configuration
+func bind(l *ldap.Conn, c *config.LdapConfig) error {
+	if !c.Authenticated {
+		return l.UnauthenticatedBind(c.BindDN)
+	}
+	return l.Bind(c.BindDN, os.Getenv(c.PasswordEnvVar))
+}
+
+// serverDialer connects and binds to another server than the configured one, such as the server of
+// a referral, and can be replaced in tests
+var serverDialer = func(s *LdapStore, server string) (ldap.Client, error) {
+	return s.dialServer(server)
+}
+
+// dialServer connects and binds to the server, given as an LDAP URL, with the configured
+// credentials and TLS settings
+func (s *LdapStore) dialServer(server string) (ldap.Client, error) {
+	l, err := ldap.DialURL(server, ldap.DialWithTLSConfig(&tls.Config{InsecureSkipVerify: s.Config.Unsecured}))
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to %v", err)
+	}
+	l.SetTimeout(5 * time.Second)
+	if s.Config.Unsecured && strings.HasPrefix(server, "ldap://") {
+		if err := l.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("Could not upgrade connection to TLS: %v", err)
+		}
+	}
+	if err := bind(l, s.Config); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Could not bind to %s: %v", server, err)
+	}
+	return l, nil
+}
+
+func (s *LdapStore) getResults(targetGroup string, baseDn *config.BaseDn, filter string, attributesList []string) ([]LdapObject, error) {
 
 	search := ldap.NewSearchRequest(
-		baseDn,
-		ldap.ScopeWholeSubtree,
-		0,
+		baseDn.DN,
+		baseDn.SearchScope(),
+		baseDn.DerefPolicy(),
 		0,
 		0,
 		false,
@@ -189,15 +335,25 @@ func (s *LdapStore) getResults(targetGroup, baseDn, filter string, attributesLis
 		[]ldap.Control{})
 
 	logger.Logger.Debug("Running SearchWithPaging",
-		zap.String("base_dn", baseDn),
+		zap.String("base_dn", baseDn.DN),
 		zap.String("filter", filter),
 		zap.Any("attributesList", attributesList))
 
-	results, connErr := s.conn.SearchWithPaging(search, searchPagingSize)
+	conn, connErr := s.searchConn(s.baseDnMapping(targetGroup))
+	if connErr != nil {
+		logger.Logger.Error("Could not connect to the LDAP server",
+			zap.String("target_group", targetGroup),
+			zap.String("error", connErr.Error()),
+		)
+		metrics.MetricServerRequestsFailed.WithLabelValues(targetGroup).Inc()
+		return []LdapObject{}, connErr
+	}
+
+	results, connErr := s.runSearch(targetGroup, conn, search, 0)
 
 	if connErr != nil {
 		logger.Logger.Error("Could not run search against LDAP",
-			zap.String("base_dn", baseDn),
+			zap.String("base_dn", baseDn.DN),
 			zap.String("error", connErr.Error()),
 		)
 		metrics.MetricServerRequestsFailed.WithLabelValues(targetGroup).Inc()
@@ -205,44 +361,60 @@ func (s *LdapStore) getResults(targetGroup, baseDn, filter string, attributesLis
 	}
 
 	logger.Logger.Debug("Building results from discovered objects",
-		zap.String("base_dn", baseDn),
+		zap.String("base_dn", baseDn.DN),
 		zap.Int("total_objects", len(results.Entries)),
 	)
 
-	obj = LdapObject{}
-	for _, e := range results.Entries {
-		if e.GetAttributeValue("dNSHostName") == "" {
-			logger.Logger.Warn("Skipping object as it's missing the dNSHostName attribute",
+	return s.buildObjects(targetGroup, baseDn.DN, results.Entries, attributesList), nil
+
+}
+
+// buildObjects converts the LDAP entries to objects, skipping the ones without a target address
+func (s *LdapStore) buildObjects(targetGroup, baseDn string, results []*ldap.Entry, attributesList []string) []LdapObject {
+	var entries []LdapObject
+
+	for _, e := range results {
+		obj := LdapObject{
+			DN:         e.DN,
+			Hostname:   e.GetAttributeValue("name"),
+			Attributes: map[string][]string{},
+		}
+
+		for _, attrib := range attributesList {
+			obj.Attributes[attrib] = e.GetAttributeValues(attrib)
+		}
+
+		obj.Address = s.objectAddress(targetGroup, obj)
+		if obj.Address == "" {
+			logger.Logger.Warn("Skipping object as none of its hostname sources could be resolved",
 				zap.String("target_group", targetGroup),
 				zap.String("base_dn", baseDn),
 				zap.Any("name", e.GetAttributeValue("name")))
+			metrics.MetricGroupExcludedObjects.WithLabelValues(targetGroup, ExcludeReasonNoHostname).Inc()
 			continue
 		}
-		obj = LdapObject{
-			Hostname:   e.GetAttributeValue("name"),
-			Attributes: map[string]string{},
-		}
-
-		if len(attributesList) >= 1 {
-			for _, attrib := range attributesList {
-				if attrib != "name" {
-					obj.Attributes[attrib] = e.GetAttributeValue(attrib)
-				}
-			}
-		}
 
 		entries = append(entries, obj)
 	}
 
-	return entries, nil
-
+	return entries
 }
 
 func (s *LdapStore) updateCache(targetGroup string, entries []LdapObject, ttl time.Duration) error {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	// The objects discovered with a configuration replaced by a reload in the meantime would
+	// otherwise be served with the new configuration
+	if s.generation != s.reloads {
+		logger.Logger.Debug("Not caching the objects discovered before a reload",
+			zap.String("cache_key", targetGroup))
+		return nil
+	}
+
 	s.cacheLock.Lock()
 	defer s.cacheLock.Unlock()
 
-	err := s.cache.Put(targetGroup, entries, ttl)
+	err := s.cache.Put(cacheKey(targetGroup), entries, ttl)
 	if err != nil {
 		logger.Logger.Error("Could not store result set in cache",
 			zap.String("cache_key", targetGroup),
@@ -256,19 +428,20 @@ func (s *LdapStore) updateCache(targetGroup string, entries []LdapObject, ttl ti
 	return nil
 }
 
-func (s *LdapStore) runDiscovery(targetGroup string) ([]LdapObject, error) {
+func (s *LdapStore) runDiscovery(ctx context.Context, targetGroup string) ([]LdapObject, error) {
 	var allEntries []LdapObject
 	var res []LdapObject
 	var attributesList []string
 	var filter string
-	var resultsErr error
+	var rejected, interrupted, succeeded bool
+	failed := searchErrors{}
 
 	if strings.TrimSpace(targetGroup) == "" {
 		return allEntries, &Error{Code: LdapStoreErrorInvalidTargetGroup}
 	}
 
 	// Fetch objects from cache if they are present and still valid
-	err := s.cache.Get(targetGroup, &allEntries)
+	err := s.cache.Get(cacheKey(targetGroup), &allEntries)
 	if err != nil && err != cachita.ErrNotFound && err != cachita.ErrExpired {
 		logger.Logger.Error("Could not fetch existing cached target group entries from cache",
 			zap.Any("error", err.Error()),
@@ -299,43 +472,56 @@ func (s *LdapStore) runDiscovery(targetGroup string) ([]LdapObject, error) {
 
 		logger.Logger.Debug("Refreshing object listing from LDAP", zap.String("group_name", targetGroup))
 
-		baseDnMapping := s.Config.BaseDnMappings[targetGroup]
-		attributesList = append(s.Config.DefaultAttributes, baseAttributes...)
+		baseDnMapping := s.baseDnMapping(targetGroup)
+		if baseDnMapping == nil {
+			return allEntries, &Error{Code: LdapStoreErrorInvalidQuery} //&LdapStoreErrorInvalidQuery{}
+		}
 
-		if len(baseDnMapping.Attributes) >= 1 {
-			for _, attrib := range baseDnMapping.Attributes {
+		attributesList = append([]string{}, s.Config.DefaultAttributes...)
+		attributesList = append(attributesList, baseAttributes...)
+		attributesList = append(attributesList, baseDnMapping.Attributes...)
+		// Attributes used to build the target addresses are fetched even if they aren't exposed as labels
+		for _, attrib := range baseDnMapping.RequiredAttributes() {
+			if !isBaseAttribute(attrib, attributesList) {
 				attributesList = append(attributesList, attrib)
 			}
 		}
-
-		if baseDnMapping == nil {
-			return allEntries, &Error{Code: LdapStoreErrorInvalidQuery} //&LdapStoreErrorInvalidQuery{}
-		}
-		if len(baseDnMapping.BaseDnList) == 0 && baseDnMapping.Filter == "" {
+		if len(baseDnMapping.BaseDnList) == 0 && baseDnMapping.Filter == "" && baseDnMapping.GroupMembership == nil && baseDnMapping.GlobalCatalog == nil {
 			logger.Logger.Error("Could not store result set in cache")
 			return allEntries, &Error{Code: LdapStoreErrorCacheUpdate} //&LdapStoreErrorCacheUpdate{}
 		}
 
-		if baseDnMapping.Filter == "(&(objectClass=computer))" || (baseDnMapping.Filter == "" && len(baseDnMapping.BaseDnList) == 0) {
-			return allEntries, &Error{Code: LdapStoreErrorInvalidQuery} //&LdapStoreErrorInvalidQuery{}
-		}
-
-		if s.Config.Filter != "" && baseDnMapping.Filter == "" {
-			filter = s.Config.Filter
-		} else if s.Config.Filter == "" && baseDnMapping.Filter != "" {
-			filter = baseDnMapping.Filter
-		} else if s.Config.Filter != "" && baseDnMapping.Filter != "" {
-			// If the top-level Filter property is set, we must combine it to any filters set at the host group level
-			filter = fmt.Sprintf("(&(%s)(%s))", s.Config.Filter, baseDnMapping.Filter)
-		} else {
-			// In this case, both  s.Config.Filter and baseDnMapping.Filter are empty, so use the default filter
-			filter = defaultLdapFilter
+		// An invalid filter fails the searches using it rather than searching with a broader filter
+		groupFilter, filterErr := s.Config.EffectiveFilter(baseDnMapping, nil)
+		if filterErr == nil {
+			filter = groupFilter.String()
 		}
 
-		if len(baseDnMapping.BaseDnList) == 0 {
-			res, resultsErr = s.getResults(targetGroup, "", filter, attributesList)
+		if baseDnMapping.GroupMembership != nil {
+			logger.Logger.Debug("Fetching LDAP objects corresponding to group membership and filter",
+				zap.String("targetGroup", targetGroup),
+				zap.Strings("groups", baseDnMapping.GroupMembership.Groups),
+				zap.String("filter", filter),
+			)
+			res, err = s.getGroupMembers(targetGroup, baseDnMapping, attributesList)
+			if errs, ok := err.(searchErrors); ok {
+				for dn, err := range errs {
+					failed[dn] = err
+				}
+			}
+			succeeded = len(failed) < len(baseDnMapping.GroupMembership.Groups)
+			allEntries = append(allEntries, res...)
+		} else if len(baseDnMapping.BaseDnList) == 0 {
+			res, err = nil, filterErr
+			if err == nil {
+				res, err = s.getResults(targetGroup, &config.BaseDn{}, filter, attributesList)
+			}
+			if err != nil {
+				failed[""] = err
+			}
+			succeeded = err == nil
+			res = s.recordSearch(targetGroup, searchKey{filter: filter}, res, err)
 
-			metrics.MetricGroupNumObjects.WithLabelValues(targetGroup).Set(float64(len(res)))
 			logger.Logger.Debug("Fetching LDAP objects corresponding to custom filter",
 				zap.String("targetGroup", targetGroup),
 				zap.String("filter", filter),
@@ -343,66 +529,97 @@ func (s *LdapStore) runDiscovery(targetGroup string) ([]LdapObject, error) {
 			allEntries = append(allEntries, res...)
 		} else {
 			for _, baseDn := range baseDnMapping.BaseDnList {
-				logger.Logger.Debug("Fetching LDAP objects corresponding to base DN and filter",
-					zap.String("base_dn", baseDn),
-					zap.String("filter", filter),
-				)
-				res, resultsErr = s.getResults(targetGroup, baseDn, filter, attributesList)
-				allEntries = append(allEntries, res...)
+				key := searchKey{dn: baseDn.DN, scope: baseDn.Scope}
+				baseDnFilter, err := s.Config.EffectiveFilter(baseDnMapping, baseDn)
+				if err == nil {
+					key.filter = baseDnFilter.String()
+					logger.Logger.Debug("Fetching LDAP objects corresponding to base DN and filter",
+						zap.String("base_dn", baseDn.DN),
+						zap.String("scope", baseDn.Scope),
+						zap.String("filter", key.filter),
+					)
+					res, err = s.getResults(targetGroup, baseDn, key.filter, attributesList)
+				} else {
+					key.filter = baseDn.Filter
+				}
+				if err != nil {
+					failed[baseDn.DN] = err
+				} else {
+					succeeded = true
+				}
+				allEntries = append(allEntries, s.recordSearch(targetGroup, key, res, err)...)
 			}
-			metrics.MetricGroupNumObjects.WithLabelValues(targetGroup).Set(float64(len(allEntries)))
 		}
 
-		if resultsErr != nil {
+		if len(failed) > 0 {
 			metrics.MetricServerRequestsFailed.WithLabelValues(targetGroup).Inc()
+			// Serving an empty group when every search failed would make Prometheus drop all its targets
+			if baseDnMapping.OnPartialFailure == config.PartialFailureFail || (!succeeded && len(allEntries) == 0) {
+				logger.Logger.Error("Failing target group as some of its searches failed",
+					zap.String("target_group", targetGroup),
+					zap.String("error", failed.Error()))
+				return []LdapObject{}, &Error{Code: LdapStoreErrorPartialFailure, Properties: map[string]string{"target_group": targetGroup, "failed": failed.Error()}}
+			}
+			logger.Logger.Warn("Serving partial target group as some of its searches failed",
+				zap.String("target_group", targetGroup),
+				zap.String("error", failed.Error()))
 		}
 
+		allEntries = s.deduplicateObjects(targetGroup, allEntries)
+		allEntries = s.excludeObjects(targetGroup, allEntries)
+		var resolveInterrupted bool
+		allEntries, resolveInterrupted = s.resolveObjects(ctx, targetGroup, allEntries)
+		interrupted = s.probeObjects(ctx, targetGroup, allEntries) || resolveInterrupted
+		if interrupted {
+			logger.Logger.Warn("The DNS resolution and exporter probes of the target group were interrupted by the request deadline",
+				zap.String("target_group", targetGroup))
+		}
+
+		allEntries, rejected, err = s.applyGuardrails(targetGroup, allEntries, !interrupted)
+		if err != nil {
+			metrics.MetricServerRequestsFailed.WithLabelValues(targetGroup).Inc()
+			return allEntries, err
+		}
+		metrics.MetricGroupNumObjects.WithLabelValues(targetGroup).Set(float64(len(allEntries)))
+
 		metrics.MetricServerRequests.WithLabelValues(targetGroup).Inc()
 
 	}
 
-	return allEntries, s.updateCache(targetGroup, allEntries, time.Duration(s.Config.CacheTTL)*time.Second)
+	ttl := time.Duration(s.Config.CacheTTL) * time.Second
+	// Partial results, the results of interrupted DNS resolutions and probes and the previous objects
+	// served in place of a rejected refresh are only cached briefly, so that the failed searches or
+	// the refresh are retried soon without every request searching again during an outage
+	if (len(failed) > 0 || rejected || interrupted) && ttl > retryCacheTTL {
+		ttl = retryCacheTTL
+	}
+	return allEntries, s.updateCache(targetGroup, allEntries, ttl)
+
+}
 
+// snapshot returns a view of the store on its current configuration, sharing its connections,
+// cache and state, so that a discovery sees a single configuration without blocking the reloads
+func (s *LdapStore) snapshot() *LdapStore {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return &LdapStore{Config: s.Config, generation: s.reloads, shared: s.shared}
 }
 
-// Serialize returns the json representation of the discovered target groups
-func (s *LdapStore) Serialize(targetGroup string) (string, error) {
+// Serialize returns the json representation of the discovered target groups.  The DNS resolution
+// and exporter probes of the objects are bounded by the deadline of the context.
+func (s *LdapStore) Serialize(ctx context.Context, targetGroup string) (string, error) {
+	view := s.snapshot()
 
-	if _, ok := s.Config.BaseDnMappings[targetGroup]; !ok {
+	if view.baseDnMapping(targetGroup) == nil {
 		return "", &Error{Code: LdapStoreErrorInvalidQuery, Properties: map[string]string{"target_group": targetGroup}} //&LdapStoreErrorInvalidTargetGroup{targetGroup}
 	}
 
-	res, err := s.runDiscovery(targetGroup)
+	res, err := view.runDiscovery(ctx, targetGroup)
 	if err != nil {
 		return "", err
 	}
 
-	tgList := []TargetGroup{}
-
-	for _, ldapObject := range res {
-
-		tg := TargetGroup{
-			Targets: []string{},
-			Labels:  map[string]string{},
-		}
-
-		tg.Targets = append(tg.Targets, strings.Join(
-			[]string{
-				ldapObject.Attributes["dNSHostName"],
-				strconv.Itoa(s.Config.BaseDnMappings[targetGroup].ExporterPort),
-			}, ":"))
-
-		for k, v := range ldapObject.Attributes {
-			if isBaseAttribute(k, baseAttributes) {
-				continue
-			}
-			if _, ok := tg.Labels[k]; !ok {
-				tg.Labels[fmt.Sprintf("__meta_ldap_%s", keyToSnakeCase(k))] = v
-			}
-		}
-
-		tgList = append(tgList, tg)
-	}
+	tgList := view.buildTargetGroups(targetGroup, res)
 
 	output, _ := json.Marshal(tgList)
 	return string(output), nil
@@ -416,8 +633,23 @@ func (s *LdapStore) IsReady() bool {
 
 // Shutdown handles the shutdown procedure of the discovery server.
 func (s *LdapStore) Shutdown() {
+	s.reloadLock.Lock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.reloadLock.Unlock()
+
+	s.connLock.Lock()
 	if s.conn != nil {
 		s.conn.Close()
 		s.conn = nil
 	}
+	s.connLock.Unlock()
+	s.gcLock.Lock()
+	for server, conn := range s.gcConns {
+		conn.Close()
+		delete(s.gcConns, server)
+	}
+	s.gcLock.Unlock()
 }
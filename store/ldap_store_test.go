@@ -0,0 +1,98 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gadelkareem/cachita"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+func TestGetResultsSearchOptions(t *testing.T) {
+
+	dir := &fakeDirectory{
+		subtree: []*ldap.Entry{
+			ldap.NewEntry("CN=host01,OU=Servers,DC=example,DC=org", map[string][]string{"name": {"host01"}, "dNSHostName": {"host01.example.org"}}),
+		},
+	}
+	mapping := &config.BaseDnMapping{
+		BaseDnList: []*config.BaseDn{
+			{DN: "OU=Servers,DC=example,DC=org", Scope: config.ScopeOne, DerefAliases: config.DerefSearching},
+			{DN: "OU=Desktops,DC=example,DC=org", Filter: "(operatingSystem=Windows*)"},
+		},
+		Filter:       "(objectClass=computer)",
+		ExporterPort: 9182,
+	}
+	s := newTestStore(t, mapping)
+	s.conn = dir
+
+	for _, baseDn := range mapping.BaseDnList {
+		f, err := s.Config.EffectiveFilter(mapping, baseDn)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if _, err := s.getResults("test", baseDn, f.String(), []string{"name", "dNSHostName"}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	expected := []struct {
+		scope  int
+		deref  int
+		filter string
+	}{
+		{ldap.ScopeSingleLevel, ldap.DerefInSearching, "(objectClass=computer)"},
+		{ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, "(operatingSystem=Windows*)"},
+	}
+	for i, search := range dir.searches {
+		if search.BaseDN != mapping.BaseDnList[i].DN || search.Scope != expected[i].scope ||
+			search.DerefAliases != expected[i].deref || search.Filter != expected[i].filter {
+			t.Errorf("Unexpected search request for base DN %d: %+v", i, search)
+		}
+	}
+}
+
+func TestRunDiscoveryAllSearchesFailed(t *testing.T) {
+
+	s := newTestStore(t, &config.BaseDnMapping{
+		BaseDnList:   []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}, {DN: "OU=Desktops,DC=example,DC=org"}},
+		ExporterPort: 9182,
+	})
+	cache, err := cachita.NewFileCache(t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Could not create cache: %s", err)
+	}
+	s.cache = cache
+	dir := &referralDirectory{errors: map[string]error{
+		"OU=Servers,DC=example,DC=org":  errors.New("timeout"),
+		"OU=Desktops,DC=example,DC=org": errors.New("timeout"),
+	}}
+	s.conn = dir
+
+	// The group fails rather than being served empty when none of its searches ever succeeded
+	res, err := s.runDiscovery(context.Background(), "test")
+	if e, ok := err.(*Error); !ok || e.Code != LdapStoreErrorPartialFailure || len(res) != 0 {
+		t.Fatalf("Expecting a partial failure error, got %d objects (%v)", len(res), err)
+	}
+
+	// The objects of the last successful search are served when every search fails afterwards
+	delete(dir.errors, "OU=Servers,DC=example,DC=org")
+	dir.results = map[string]*ldap.SearchResult{
+		"OU=Servers,DC=example,DC=org": {Entries: []*ldap.Entry{
+			ldap.NewEntry("CN=host01,OU=Servers,DC=example,DC=org", map[string][]string{"name": {"host01"}, "dNSHostName": {"host01.example.org"}}),
+		}},
+	}
+	if res, err := s.runDiscovery(context.Background(), "test"); err != nil || len(res) != 1 {
+		t.Fatalf("Expecting the object of the successful search, got %d objects (%v)", len(res), err)
+	}
+	if err := s.cache.Invalidate(cacheKey("test")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	dir.errors["OU=Servers,DC=example,DC=org"] = errors.New("timeout")
+	if res, err := s.runDiscovery(context.Background(), "test"); err != nil || len(res) != 1 {
+		t.Errorf("Expecting the object of the last successful search, got %d objects (%v)", len(res), err)
+	}
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/metrics"
+	"go.uber.org/zap"
+)
+
+// probeTarget checks if the exporter listening on the address is reachable
+func probeTarget(ctx context.Context, address string, opts *config.ExporterProbe) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(opts.Timeout))
+	defer cancel()
+
+	if opts.Method == config.ProbeMethodHTTP {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s%s", address, opts.Path), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeObjects probes the exporter of each target of the objects concurrently, according to
+// the exporter probe configuration of the target group, and stores the results in the objects.
+// The probes which couldn't complete before the deadline of the context are left without result,
+// in which case interrupted is true.
+func (s *LdapStore) probeObjects(ctx context.Context, targetGroup string, objects []LdapObject) (interrupted bool) {
+	baseDnMapping := s.baseDnMapping(targetGroup)
+	opts := baseDnMapping.ExporterProbe
+	if opts == nil {
+		return false
+	}
+
+	type probe struct {
+		obj     *LdapObject
+		port    string
+		address string
+	}
+	probes := []probe{}
+	for i := range objects {
+		objects[i].Reachable = map[string]bool{}
+		host := targetHost(baseDnMapping, objects[i])
+		for _, port := range baseDnMapping.ExporterPorts {
+			if portNum := objectPort(port, objects[i]); portNum != 0 && host != "" {
+				probes = append(probes, probe{
+					obj:     &objects[i],
+					port:    port.Name,
+					address: net.JoinHostPort(host, strconv.Itoa(portNum)),
+				})
+			}
+		}
+	}
+
+	var lock sync.Mutex
+	reachable, completed := 0, 0
+	forEachConcurrently(len(probes), opts.Concurrency, func(i int) {
+		p := probes[i]
+		err := probeTarget(ctx, p.address, opts)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Logger.Debug("Exporter probe failed",
+				zap.String("target_group", targetGroup),
+				zap.String("address", p.address),
+				zap.String("error", err.Error()))
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		p.obj.Reachable[p.port] = err == nil
+		completed++
+		if err == nil {
+			reachable++
+		}
+	})
+
+	metrics.MetricGroupProbedTargets.WithLabelValues(targetGroup, "reachable").Set(float64(reachable))
+	metrics.MetricGroupProbedTargets.WithLabelValues(targetGroup, "unreachable").Set(float64(completed - reachable))
+	return completed < len(probes)
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gadelkareem/cachita"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+func TestProbeObjects(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	_, serverPort, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	// Find a port on which nothing is listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	_, closedPort, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	for _, method := range []string{"tcp", "http"} {
+		s := newTestStore(t, &config.BaseDnMapping{
+			BaseDnList: []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+			ExporterPorts: []*config.ExporterPort{
+				{Name: "up", PortAttribute: "upPort"},
+				{Name: "down", PortAttribute: "downPort"},
+			},
+			ExporterProbe: &config.ExporterProbe{Method: method},
+		})
+
+		objects := []LdapObject{
+			{Hostname: "local", Address: "127.0.0.1", Attributes: map[string][]string{"upPort": {serverPort}, "downPort": {closedPort}}},
+		}
+		s.probeObjects(context.Background(), "test", objects)
+
+		if !objects[0].Reachable["up"] || objects[0].Reachable["down"] {
+			t.Errorf("Method %s: unexpected probe results %v", method, objects[0].Reachable)
+		}
+
+		tgList := s.buildTargetGroups("test", objects)
+		if len(tgList) != 2 || tgList[0].Labels["__meta_ldap_exporter_reachable"] != "true" || tgList[1].Labels["__meta_ldap_exporter_reachable"] != "false" {
+			t.Errorf("Method %s: unexpected target groups %+v", method, tgList)
+		}
+
+		// Probes interrupted by the deadline are left without result, and their targets unlabelled
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if !s.probeObjects(ctx, "test", objects) {
+			t.Errorf("Method %s: expecting the probes to be interrupted", method)
+		}
+		if _, ok := objects[0].Reachable["up"]; ok {
+			t.Errorf("Method %s: expecting interrupted probe to have no result, got %v", method, objects[0].Reachable)
+		}
+		tgList = s.buildTargetGroups("test", objects)
+		if _, ok := tgList[0].Labels["__meta_ldap_exporter_reachable"]; ok {
+			t.Errorf("Method %s: expecting the target of the interrupted probe to be unlabelled, got %+v", method, tgList[0].Labels)
+		}
+	}
+}
+
+// ttlCache records the TTL with which each key was cached
+type ttlCache struct {
+	cachita.Cache
+	ttls map[string]time.Duration
+}
+
+func (c *ttlCache) Put(key string, value interface{}, ttl time.Duration) error {
+	c.ttls[key] = ttl
+	return c.Cache.Put(key, value, ttl)
+}
+
+func TestInterruptedProbesCaching(t *testing.T) {
+
+	s := newTestStore(t, &config.BaseDnMapping{
+		BaseDnList:    []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+		ExporterPort:  9182,
+		ExporterProbe: &config.ExporterProbe{},
+		Guardrails:    &config.Guardrails{MaxObjects: 10},
+	})
+	s.Config.CacheTTL = 600
+	cache, err := cachita.NewFileCache(t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Could not create cache: %s", err)
+	}
+	c := &ttlCache{Cache: cache, ttls: map[string]time.Duration{}}
+	s.cache = c
+	s.conn = &referralDirectory{results: map[string]*ldap.SearchResult{
+		"OU=Servers,DC=example,DC=org": {Entries: []*ldap.Entry{
+			ldap.NewEntry("CN=host01,OU=Servers,DC=example,DC=org", map[string][]string{"name": {"host01"}, "dNSHostName": {"127.0.0.1"}}),
+		}},
+	}}
+
+	// The objects whose probes were interrupted by the deadline are cached briefly, so that the
+	// refresh converges, but aren't kept as the last accepted refresh of the guardrails
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err := s.runDiscovery(ctx, "test")
+	if err != nil || len(res) != 1 {
+		t.Fatalf("Expecting 1 object, got %d (%v)", len(res), err)
+	}
+	if ttl, ok := c.ttls[cacheKey("test")]; !ok || ttl != retryCacheTTL {
+		t.Errorf("Expecting the objects to be cached for %s, got %s (cached: %t)", retryCacheTTL, ttl, ok)
+	}
+	if _, ok := s.snapshots["test"]; ok {
+		t.Errorf("Expecting the interrupted refresh not to be kept for the guardrails")
+	}
+	if _, ok := c.ttls[snapshotKey("test")]; ok {
+		t.Errorf("Expecting the interrupted refresh not to be persisted for the guardrails")
+	}
+}
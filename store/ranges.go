@@ -0,0 +1,103 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"go.uber.org/zap"
+)
+
+// rangeOption is the attribute option of the values of a multi-valued attribute returned in
+// ranges by ActiveDirectory, as in member;range=0-1499
+const rangeOption = ";range="
+
+// parseRange splits a ranged attribute description into the attribute name and the index of the
+// last value of the range, or -1 for the last range (member;range=1500-*).  ok is false when the
+// attribute isn't ranged.
+func parseRange(attr string) (name string, end int, ok bool) {
+	i := strings.Index(strings.ToLower(attr), rangeOption)
+	if i < 0 {
+		return attr, 0, false
+	}
+	bounds := strings.SplitN(attr[i+len(rangeOption):], "-", 2)
+	if len(bounds) != 2 {
+		return attr, 0, false
+	}
+	if _, err := strconv.Atoi(bounds[0]); err != nil {
+		return attr, 0, false
+	}
+	if bounds[1] == "*" {
+		return attr[:i], -1, true
+	}
+	end, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return attr, 0, false
+	}
+	return attr[:i], end, true
+}
+
+// completeRangedAttributes replaces the ranged attributes of the entries with all their values,
+// reading the following ranges of each attribute until the last one
+func completeRangedAttributes(conn ldap.Client, entries []*ldap.Entry) error {
+	for _, e := range entries {
+		attributes := make([]*ldap.EntryAttribute, 0, len(e.Attributes))
+		for _, attr := range e.Attributes {
+			name, end, ok := parseRange(attr.Name)
+			if !ok {
+				attributes = append(attributes, attr)
+				continue
+			}
+
+			complete := &ldap.EntryAttribute{
+				Name:       name,
+				Values:     append([]string{}, attr.Values...),
+				ByteValues: append([][]byte{}, attr.ByteValues...),
+			}
+			for end >= 0 {
+				next, err := readRange(conn, e.DN, name, end+1)
+				if err != nil {
+					return fmt.Errorf("Could not read the values of %s from %d for %s: %v", name, end+1, e.DN, err)
+				}
+				if next == nil {
+					break
+				}
+				complete.Values = append(complete.Values, next.Values...)
+				complete.ByteValues = append(complete.ByteValues, next.ByteValues...)
+				previous := end
+				if _, end, _ = parseRange(next.Name); end >= 0 && end <= previous {
+					return fmt.Errorf("The range of %s returned for %s doesn't progress past %d", name, e.DN, previous)
+				}
+			}
+
+			logger.Logger.Debug("Read ranged attribute values",
+				zap.String("dn", e.DN),
+				zap.String("attribute", name),
+				zap.Int("num_values", len(complete.Values)))
+			attributes = append(attributes, complete)
+		}
+		e.Attributes = attributes
+	}
+	return nil
+}
+
+// readRange reads the values of the attribute of the entry starting at the index, returning nil
+// when the server doesn't return a range
+func readRange(conn ldap.Client, dn, name string, start int) (*ldap.EntryAttribute, error) {
+	search := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{fmt.Sprintf("%s%s%d-*", name, rangeOption, start)}, nil)
+	res, err := conn.Search(search)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range res.Entries {
+		for _, attr := range e.Attributes {
+			if attrName, _, ok := parseRange(attr.Name); ok && strings.EqualFold(attrName, name) {
+				return attr, nil
+			}
+		}
+	}
+	return nil, nil
+}
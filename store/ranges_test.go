@@ -0,0 +1,89 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// rangeDirectory returns the values of the member attribute in ranges of size values, as
+// ActiveDirectory does beyond its MaxValRange
+type rangeDirectory struct {
+	ldap.Client
+	members  map[string][]string
+	size     int
+	searches int
+}
+
+func (d *rangeDirectory) rangedMembers(dn string, start int) *ldap.EntryAttribute {
+	members := d.members[dn]
+	end := start + d.size - 1
+	if end >= len(members)-1 {
+		return &ldap.EntryAttribute{Name: fmt.Sprintf("member;range=%d-*", start), Values: members[start:]}
+	}
+	return &ldap.EntryAttribute{Name: fmt.Sprintf("member;range=%d-%d", start, end), Values: members[start : end+1]}
+}
+
+func (d *rangeDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	d.searches++
+	var start int
+	if _, err := fmt.Sscanf(strings.ToLower(req.Attributes[0]), "member;range=%d-*", &start); err != nil {
+		return nil, err
+	}
+	entry := &ldap.Entry{DN: req.BaseDN, Attributes: []*ldap.EntryAttribute{d.rangedMembers(req.BaseDN, start)}}
+	return &ldap.SearchResult{Entries: []*ldap.Entry{entry}}, nil
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		attr string
+		name string
+		end  int
+		ok   bool
+	}{
+		{"member;range=0-1499", "member", 1499, true},
+		{"member;Range=1500-*", "member", -1, true},
+		{"member;binary;range=0-9", "member;binary", 9, true},
+		{"member", "member", 0, false},
+		{"member;range=0", "member;range=0", 0, false},
+		{"member;range=a-*", "member;range=a-*", 0, false},
+	}
+	for _, test := range tests {
+		name, end, ok := parseRange(test.attr)
+		if name != test.name || end != test.end || ok != test.ok {
+			t.Errorf("Expecting %q, %d, %t for %s, got %q, %d, %t", test.name, test.end, test.ok, test.attr, name, end, ok)
+		}
+	}
+}
+
+func TestCompleteRangedAttributes(t *testing.T) {
+
+	group := "CN=Servers,OU=Groups,DC=example,DC=org"
+	members := []string{}
+	for i := 0; i < 7; i++ {
+		members = append(members, fmt.Sprintf("CN=host%02d,OU=Servers,DC=example,DC=org", i))
+	}
+	dir := &rangeDirectory{members: map[string][]string{group: members}, size: 3}
+
+	entries := []*ldap.Entry{
+		{DN: group, Attributes: []*ldap.EntryAttribute{
+			{Name: "cn", Values: []string{"Servers"}},
+			dir.rangedMembers(group, 0),
+		}},
+	}
+	if err := completeRangedAttributes(dir, entries); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if values := entries[0].GetAttributeValues("member"); !reflect.DeepEqual(values, members) {
+		t.Errorf("Expecting members %v, got %v", members, values)
+	}
+	if entries[0].GetAttributeValue("cn") != "Servers" {
+		t.Errorf("Expecting the other attributes to be kept")
+	}
+	if dir.searches != 2 {
+		t.Errorf("Expecting 2 range searches, got %d", dir.searches)
+	}
+}
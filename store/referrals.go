@@ -0,0 +1,185 @@
+package store
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/metrics"
+	"go.uber.org/zap"
+)
+
+// Referral results
+const (
+	ReferralFollowed = "followed"
+	ReferralFailed   = "failed"
+)
+
+// referral is a parsed LDAP URL returned as a referral, as in ldap://host:port/DN??scope
+type referral struct {
+	server string
+	host   string
+	baseDN string
+	// scope is the search scope, or -1 to keep the scope of the original search
+	scope int
+}
+
+// parseReferral parses an LDAP URL returned as a referral (see https://tools.ietf.org/html/rfc4516)
+func parseReferral(raw string) (*referral, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("unsupported referral URL %q", raw)
+	}
+
+	ref := &referral{server: u.Scheme + "://" + u.Host, host: u.Hostname(), baseDN: strings.TrimPrefix(u.Path, "/"), scope: -1}
+	// The query holds the attributes, scope, filter and extensions separated by question marks
+	if parts := strings.Split(u.RawQuery, "?"); len(parts) >= 2 {
+		switch strings.ToLower(parts[1]) {
+		case "base":
+			ref.scope = ldap.ScopeBaseObject
+		case "one":
+			ref.scope = ldap.ScopeSingleLevel
+		case "sub":
+			ref.scope = ldap.ScopeWholeSubtree
+		}
+	}
+	return ref, nil
+}
+
+// referralsFromError returns the URLs of the referral returned as the result of a search, if any
+func referralsFromError(err error) []string {
+	ldapErr, ok := err.(*ldap.Error)
+	if !ok || ldapErr.ResultCode != ldap.LDAPResultReferral || ldapErr.Packet == nil || len(ldapErr.Packet.Children) < 2 {
+		return nil
+	}
+	var urls []string
+	for _, child := range ldapErr.Packet.Children[1].Children {
+		if child.ClassType != ber.ClassContext || child.Tag != 3 {
+			continue
+		}
+		for _, u := range child.Children {
+			if value, ok := u.Value.(string); ok {
+				urls = append(urls, value)
+			}
+		}
+	}
+	return urls
+}
+
+// runSearch runs the search, reading all the values of the ranged attributes of the entries and,
+// when enabled, following the returned referrals up to the maximum number of hops to add the
+// entries found on the referred servers to the results
+func (s *LdapStore) runSearch(targetGroup string, conn ldap.Client, search *ldap.SearchRequest, hop int) (*ldap.SearchResult, error) {
+	follow := s.Config.Referrals != nil && s.Config.Referrals.Follow
+
+	res, err := conn.SearchWithPaging(search, searchPagingSize)
+	var referrals []string
+	if err != nil {
+		referrals = referralsFromError(err)
+		if !follow || len(referrals) == 0 {
+			return res, err
+		}
+		// The entries returned along with the referral are kept with those of the referred servers
+		if res == nil {
+			res = &ldap.SearchResult{}
+		}
+	}
+	if err := completeRangedAttributes(conn, res.Entries); err != nil {
+		return nil, err
+	}
+	referrals = append(referrals, res.Referrals...)
+	if len(referrals) == 0 {
+		return res, nil
+	}
+	if !follow {
+		logger.Logger.Debug("Ignoring referrals returned by the search",
+			zap.String("target_group", targetGroup),
+			zap.String("base_dn", search.BaseDN),
+			zap.Strings("referrals", referrals))
+		return res, nil
+	}
+
+	result := &ldap.SearchResult{Entries: res.Entries, Controls: res.Controls}
+	for _, raw := range referrals {
+		if hop >= s.Config.Referrals.MaxHops {
+			logger.Logger.Warn("Not following referral beyond the maximum number of hops",
+				zap.String("target_group", targetGroup),
+				zap.String("referral", raw),
+				zap.Int("max_hops", s.Config.Referrals.MaxHops))
+			metrics.MetricReferrals.WithLabelValues(targetGroup, ReferralFailed).Inc()
+			continue
+		}
+		entries, err := s.followReferral(targetGroup, search, raw, hop+1)
+		if err != nil {
+			metrics.MetricReferrals.WithLabelValues(targetGroup, ReferralFailed).Inc()
+			return nil, fmt.Errorf("Could not follow referral %s: %v", raw, err)
+		}
+		metrics.MetricReferrals.WithLabelValues(targetGroup, ReferralFollowed).Inc()
+		result.Entries = append(result.Entries, entries...)
+	}
+	return result, nil
+}
+
+// checkReferral returns an error if the server of the referral isn't one of the allowed hosts, or
+// if it would be bound to without TLS while it's neither listed by name nor the configured server,
+// so that the credentials are only sent to trusted servers
+func (s *LdapStore) checkReferral(ref *referral) error {
+	if !s.Config.Referrals.AllowsHost(ref.host) {
+		return fmt.Errorf("%s isn't one of the allowed hosts of the referrals", ref.host)
+	}
+	serverHost, _, err := net.SplitHostPort(s.Config.URL)
+	if err != nil {
+		serverHost = s.Config.URL
+	}
+	plaintext := strings.HasPrefix(ref.server, "ldap://") && !s.Config.Unsecured
+	if plaintext && !s.Config.Referrals.ListsHost(ref.host) && !strings.EqualFold(ref.host, serverHost) {
+		return fmt.Errorf("refusing to bind without TLS to %s which is only allowed by a domain suffix", ref.host)
+	}
+	return nil
+}
+
+// followReferral runs the search on the server of the referral, with the base DN and scope of the
+// referral when set
+func (s *LdapStore) followReferral(targetGroup string, search *ldap.SearchRequest, raw string, hop int) ([]*ldap.Entry, error) {
+	ref, err := parseReferral(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkReferral(ref); err != nil {
+		return nil, err
+	}
+
+	conn, err := serverDialer(s, ref.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	referred := *search
+	referred.Controls = nil
+	if ref.baseDN != "" {
+		referred.BaseDN = ref.baseDN
+	}
+	if ref.scope >= 0 {
+		referred.Scope = ref.scope
+	}
+
+	logger.Logger.Debug("Following referral",
+		zap.String("target_group", targetGroup),
+		zap.String("server", ref.server),
+		zap.String("base_dn", referred.BaseDN),
+		zap.Int("hop", hop))
+
+	res, err := s.runSearch(targetGroup, conn, &referred, hop)
+	if err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
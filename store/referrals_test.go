@@ -0,0 +1,184 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+// referralDirectory answers the searches with the canned result of their base DN
+type referralDirectory struct {
+	ldap.Client
+	results  map[string]*ldap.SearchResult
+	errors   map[string]error
+	searches []*ldap.SearchRequest
+}
+
+func (d *referralDirectory) SearchWithPaging(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	d.searches = append(d.searches, req)
+	// The entries received before the error, such as along with a referral, are returned with it
+	if err, ok := d.errors[req.BaseDN]; ok {
+		return d.results[req.BaseDN], err
+	}
+	if res, ok := d.results[req.BaseDN]; ok {
+		return res, nil
+	}
+	return &ldap.SearchResult{}, nil
+}
+
+func (d *referralDirectory) Close() {}
+
+func (d *referralDirectory) IsClosing() bool {
+	return false
+}
+
+// referralError builds the error returned by go-ldap for a search result with the referral code
+func referralError(urls ...string) error {
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultDone, nil, "")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(ldap.LDAPResultReferral), ""))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	referrals := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "")
+	for _, u := range urls {
+		referrals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, u, ""))
+	}
+	response.AppendChild(referrals)
+
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(1), ""))
+	packet.AppendChild(response)
+	return ldap.GetLDAPError(packet)
+}
+
+func TestParseReferral(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected referral
+	}{
+		{"ldap://child.example.org/DC=child,DC=example,DC=org", referral{server: "ldap://child.example.org", host: "child.example.org", baseDN: "DC=child,DC=example,DC=org", scope: -1}},
+		{"ldaps://child.example.org:636/OU=Servers,DC=child,DC=example,DC=org??one", referral{server: "ldaps://child.example.org:636", host: "child.example.org", baseDN: "OU=Servers,DC=child,DC=example,DC=org", scope: ldap.ScopeSingleLevel}},
+		{"ldap://child.example.org/CN=Web%20Servers,DC=child,DC=example,DC=org", referral{server: "ldap://child.example.org", host: "child.example.org", baseDN: "CN=Web Servers,DC=child,DC=example,DC=org", scope: -1}},
+		{"ldap://child.example.org", referral{server: "ldap://child.example.org", host: "child.example.org", scope: -1}},
+	}
+	for _, test := range tests {
+		ref, err := parseReferral(test.raw)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", test.raw, err)
+			continue
+		}
+		if *ref != test.expected {
+			t.Errorf("Expecting %+v for %s, got %+v", test.expected, test.raw, *ref)
+		}
+	}
+
+	for _, raw := range []string{"http://child.example.org/", "ldap:///DC=example,DC=org"} {
+		if _, err := parseReferral(raw); err == nil {
+			t.Errorf("Expecting error for %s", raw)
+		}
+	}
+}
+
+func TestSearchWithReferrals(t *testing.T) {
+
+	host := func(dn, name string) *ldap.Entry {
+		return ldap.NewEntry(dn, map[string][]string{"name": {name}, "dNSHostName": {name + ".example.org"}})
+	}
+	child := &referralDirectory{
+		results: map[string]*ldap.SearchResult{
+			"DC=child,DC=example,DC=org": {
+				Entries:   []*ldap.Entry{host("CN=child01,DC=child,DC=example,DC=org", "child01")},
+				Referrals: []string{"ldap://grandchild.example.org/DC=grandchild,DC=child,DC=example,DC=org"},
+			},
+		},
+	}
+	grandchild := &referralDirectory{
+		results: map[string]*ldap.SearchResult{
+			"DC=grandchild,DC=child,DC=example,DC=org": {Entries: []*ldap.Entry{host("CN=grandchild01,DC=grandchild,DC=child,DC=example,DC=org", "grandchild01")}},
+		},
+	}
+	root := &referralDirectory{
+		results: map[string]*ldap.SearchResult{
+			"DC=example,DC=org": {
+				Entries:   []*ldap.Entry{host("CN=root01,DC=example,DC=org", "root01")},
+				Referrals: []string{"ldap://child.example.org/DC=child,DC=example,DC=org"},
+			},
+			"OU=Moved,DC=example,DC=org": {
+				Entries: []*ldap.Entry{host("CN=moved01,OU=Moved,DC=example,DC=org", "moved01")},
+			},
+		},
+		errors: map[string]error{
+			"OU=Moved,DC=example,DC=org": referralError("ldap://child.example.org/DC=child,DC=example,DC=org"),
+		},
+	}
+
+	dialer := serverDialer
+	defer func() { serverDialer = dialer }()
+	serverDialer = func(s *LdapStore, server string) (ldap.Client, error) {
+		switch server {
+		case "ldap://child.example.org":
+			return child, nil
+		case "ldap://grandchild.example.org":
+			return grandchild, nil
+		}
+		return nil, errors.New("unknown server")
+	}
+
+	listed := []string{"child.example.org", "grandchild.example.org"}
+	suffix := []string{".example.org"}
+	tests := []struct {
+		baseDn    string
+		referrals *config.Referrals
+		unsecured bool
+		expected  []string
+	}{
+		{"DC=example,DC=org", nil, false, []string{"root01"}},
+		{"DC=example,DC=org", &config.Referrals{Follow: true, MaxHops: 3, AllowedHosts: listed}, false, []string{"root01", "child01", "grandchild01"}},
+		{"DC=example,DC=org", &config.Referrals{Follow: true, MaxHops: 1, AllowedHosts: listed}, false, []string{"root01", "child01"}},
+		// The entries returned along with a referral result are kept
+		{"OU=Moved,DC=example,DC=org", &config.Referrals{Follow: true, MaxHops: 3, AllowedHosts: listed}, false, []string{"moved01", "child01", "grandchild01"}},
+		// The hosts allowed by a domain suffix are only bound to with TLS
+		{"DC=example,DC=org", &config.Referrals{Follow: true, MaxHops: 3, AllowedHosts: suffix}, true, []string{"root01", "child01", "grandchild01"}},
+		{"DC=example,DC=org", &config.Referrals{Follow: true, MaxHops: 3, AllowedHosts: suffix}, false, nil},
+		// The referrals to the hosts which aren't allowed fail the search
+		{"DC=example,DC=org", &config.Referrals{Follow: true, MaxHops: 3, AllowedHosts: []string{"child.example.org"}}, false, nil},
+	}
+	for i, test := range tests {
+		s := newTestStore(t, &config.BaseDnMapping{
+			BaseDnList:   []*config.BaseDn{{DN: test.baseDn}},
+			ExporterPort: 9182,
+		})
+		s.Config.URL = "ldap.example.org:389"
+		s.Config.Referrals = test.referrals
+		s.Config.Unsecured = test.unsecured
+		s.conn = root
+
+		objects, err := s.getResults("test", s.Config.BaseDnMappings["test"].BaseDnList[0], "(objectClass=computer)", []string{"name", "dNSHostName"})
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("Expecting the referral to be refused for test %d", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for test %d: %s", i, err)
+		}
+		if len(objects) != len(test.expected) {
+			t.Fatalf("Expecting %d objects for test %d, got %d", len(test.expected), i, len(objects))
+		}
+		for j, o := range objects {
+			if o.Hostname != test.expected[j] {
+				t.Errorf("Expecting object %s for test %d, got %s", test.expected[j], i, o.Hostname)
+			}
+		}
+	}
+
+	// The referral error is returned when referrals aren't followed
+	s := newTestStore(t, &config.BaseDnMapping{BaseDnList: []*config.BaseDn{{DN: "OU=Moved,DC=example,DC=org"}}, ExporterPort: 9182})
+	s.conn = root
+	if _, err := s.getResults("test", s.Config.BaseDnMappings["test"].BaseDnList[0], "(objectClass=computer)", []string{"name"}); !ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) {
+		t.Errorf("Expecting referral error, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"time"
+
+	"github.com/gadelkareem/cachita"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"go.uber.org/zap"
+)
+
+// Reload atomically swaps the configuration of the store.  The discoveries in progress complete with
+// the snapshot of the configuration they started with.  The connections are closed, and dialed again
+// by the next search, only when the connection settings changed, and only the cached objects of the
+// changed target groups are invalidated.
+func (s *LdapStore) Reload(c *config.LdapConfig) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	previous := s.Config
+	c.MaxReconnectAttempts = previous.MaxReconnectAttempts
+
+	if c.CacheDir != previous.CacheDir {
+		cache, err := cachita.NewFileCache(c.CacheDir, time.Duration(c.CacheTTL)*time.Second, 5*time.Minute)
+		if err != nil {
+			return err
+		}
+		s.cacheLock.Lock()
+		s.cache = cache
+		s.cacheLock.Unlock()
+	}
+
+	s.connLock.Lock()
+	s.connConfig = c
+	s.connLock.Unlock()
+
+	if previous.ConnectionChanged(c) {
+		logger.Logger.Info("Connection settings changed, closing the LDAP connections")
+		s.connLock.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		s.ReconnectAttempts = 0
+		s.activeDirectory = nil
+		s.connLock.Unlock()
+
+		s.gcLock.Lock()
+		for server, conn := range s.gcConns {
+			conn.Close()
+			delete(s.gcConns, server)
+		}
+		s.gcLock.Unlock()
+	}
+
+	// The connections to the Global Catalog servers which are no longer searched are closed
+	servers := c.GlobalCatalogURLs()
+	s.gcLock.Lock()
+	for server, conn := range s.gcConns {
+		if !servers[server] {
+			logger.Logger.Info("Closing the connection to the Global Catalog server which is no longer searched",
+				zap.String("server", server))
+			conn.Close()
+			delete(s.gcConns, server)
+		}
+	}
+	s.gcLock.Unlock()
+
+	changedGroups := previous.ChangedGroups(c)
+	changedTemplates := previous.ChangedTemplates(c)
+
+	// The groups generated by the changed templates are generated again by the next refresh
+	s.mappingsLock.Lock()
+	for _, name := range changedTemplates {
+		for group := range s.generatedMappings[name] {
+			changedGroups = append(changedGroups, group)
+		}
+		delete(s.generatedMappings, name)
+	}
+	s.mappingsLock.Unlock()
+
+	for _, group := range changedGroups {
+		s.invalidateGroup(group)
+	}
+	logger.Logger.Info("Reloaded LDAP store configuration",
+		zap.Strings("changed_groups", changedGroups),
+		zap.Strings("changed_templates", changedTemplates))
+
+	if s.stop != nil {
+		close(s.stop)
+	}
+	s.stop = make(chan struct{})
+	s.Config = c
+	s.reloads++
+	s.generation = s.reloads
+	s.StartGroupTemplates()
+	return nil
+}
+
+// invalidateGroup drops the cached objects of the target group along with the objects of its
+// previous searches, which the partial failure handling would otherwise serve in place of the
+// objects of its new configuration, and the objects of its last accepted refresh, so that the
+// guardrails don't reject the intended result of the new configuration.
+func (s *LdapStore) invalidateGroup(targetGroup string) {
+	s.snapshotLock.Lock()
+	delete(s.snapshots, targetGroup)
+	s.snapshotLock.Unlock()
+
+	s.cacheLock.Lock()
+	for _, key := range []string{cacheKey(targetGroup), snapshotKey(targetGroup)} {
+		if err := s.cache.Invalidate(key); err != nil && err != cachita.ErrNotFound {
+			logger.Logger.Warn("Could not invalidate the cached target group objects",
+				zap.String("target_group", targetGroup),
+				zap.String("cache_key", key),
+				zap.String("error", err.Error()))
+		}
+	}
+	s.cacheLock.Unlock()
+
+	s.statusLock.Lock()
+	delete(s.searches, targetGroup)
+	s.statusLock.Unlock()
+}
@@ -0,0 +1,211 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gadelkareem/cachita"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+func TestReload(t *testing.T) {
+
+	newConfig := func(desktopsFilter string) *config.LdapConfig {
+		c := &config.LdapConfig{
+			URL:               "ldap.example.org:389",
+			BindDN:            "CN=ro_user,DC=example,DC=org",
+			DefaultAttributes: []string{"operatingSystem"},
+			CacheDir:          t.TempDir(),
+			BaseDnMappings: map[string]*config.BaseDnMapping{
+				"servers":  {BaseDnList: []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: 9182, Guardrails: &config.Guardrails{MaxShrinkPercent: 50}},
+				"desktops": {BaseDnList: []*config.BaseDn{{DN: "OU=Desktops,DC=example,DC=org"}}, ExporterPort: 9182, Guardrails: &config.Guardrails{MaxShrinkPercent: 50}, Filter: desktopsFilter},
+			},
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("Invalid configuration: %s", err)
+		}
+		return c
+	}
+
+	c := newConfig("(operatingSystem=Windows*)")
+	s, err := NewLdapStoreFromConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Shutdown()
+	conn := &referralDirectory{}
+	s.conn = conn
+	for _, group := range []string{"servers", "desktops"} {
+		if err := s.updateCache(group, testObjects(2), time.Hour); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		s.applyGuardrails(group, testObjects(2), true)
+	}
+
+	// Only the desktops group changed
+	reloaded := newConfig("(operatingSystem=Windows 1*)")
+	reloaded.CacheDir = c.CacheDir
+	if err := s.Reload(reloaded); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s.Config != reloaded || s.conn != conn {
+		t.Errorf("Expecting the configuration to be swapped and the connection to be kept")
+	}
+	var objects []LdapObject
+	if err := s.cache.Get(cacheKey("servers"), &objects); err != nil || len(objects) != 2 {
+		t.Errorf("Expecting the cached objects of the unchanged group to be kept, got %d (%v)", len(objects), err)
+	}
+	if err := s.cache.Get(cacheKey("desktops"), &objects); err != cachita.ErrNotFound {
+		t.Errorf("Expecting the cached objects of the changed group to be invalidated, got %v", err)
+	}
+	if _, ok := s.snapshots["servers"]; !ok {
+		t.Errorf("Expecting the last accepted objects of the unchanged group to be kept for its guardrails")
+	}
+	if _, ok := s.snapshots["desktops"]; ok {
+		t.Errorf("Expecting the last accepted objects of the changed group to be dropped")
+	}
+	var previous acceptedRefresh
+	if err := s.cache.Get(snapshotKey("desktops"), &previous); err != cachita.ErrNotFound {
+		t.Errorf("Expecting the persisted objects of the changed group to be dropped, got %v", err)
+	}
+
+	// The connection is closed when the server changes
+	changed := newConfig("(operatingSystem=Windows 1*)")
+	changed.URL = "ldap2.example.org:389"
+	changed.CacheDir = c.CacheDir
+	if err := s.Reload(changed); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s.conn != nil {
+		t.Errorf("Expecting the connection to be closed")
+	}
+	if err := s.cache.Get(cacheKey("servers"), &objects); err != cachita.ErrNotFound {
+		t.Errorf("Expecting all the cached objects to be invalidated, got %v", err)
+	}
+}
+
+// blockingDirectory blocks the searches until they're released
+type blockingDirectory struct {
+	referralDirectory
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDirectory) SearchWithPaging(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	d.started <- struct{}{}
+	<-d.release
+	return d.referralDirectory.SearchWithPaging(req, pagingSize)
+}
+
+func TestReloadDuringDiscovery(t *testing.T) {
+
+	newConfig := func(port int) *config.LdapConfig {
+		c := &config.LdapConfig{
+			URL:               "ldap.example.org:389",
+			BindDN:            "CN=ro_user,DC=example,DC=org",
+			DefaultAttributes: []string{"operatingSystem"},
+			CacheDir:          t.TempDir(),
+			CacheTTL:          600,
+			BaseDnMappings: map[string]*config.BaseDnMapping{
+				"servers": {BaseDnList: []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: port},
+			},
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("Invalid configuration: %s", err)
+		}
+		return c
+	}
+
+	c := newConfig(9182)
+	s, err := NewLdapStoreFromConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Shutdown()
+	dir := &blockingDirectory{
+		referralDirectory: referralDirectory{results: map[string]*ldap.SearchResult{
+			"OU=Servers,DC=example,DC=org": {Entries: []*ldap.Entry{
+				ldap.NewEntry("CN=host01,OU=Servers,DC=example,DC=org", map[string][]string{"name": {"host01"}, "dNSHostName": {"host01.example.org"}}),
+			}},
+		}},
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	s.conn = dir
+
+	type result struct {
+		output string
+		err    error
+	}
+	done := make(chan result)
+	go func() {
+		output, err := s.Serialize(context.Background(), "servers")
+		done <- result{output, err}
+	}()
+	<-dir.started
+
+	// The reload doesn't wait for the search in progress
+	reloaded := newConfig(9100)
+	reloaded.CacheDir = c.CacheDir
+	reloadDone := make(chan error)
+	go func() { reloadDone <- s.Reload(reloaded) }()
+	select {
+	case err := <-reloadDone:
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expecting the reload not to wait for the discovery in progress")
+	}
+	close(dir.release)
+
+	// The discovery completes with the configuration it started with, and its objects aren't cached
+	res := <-done
+	if res.err != nil || !strings.Contains(res.output, "host01.example.org:9182") {
+		t.Errorf("Expecting the target of the previous configuration, got %s (%v)", res.output, res.err)
+	}
+	var objects []LdapObject
+	if err := s.cache.Get(cacheKey("servers"), &objects); err != cachita.ErrNotFound {
+		t.Errorf("Expecting the objects discovered before the reload not to be cached, got %v", err)
+	}
+}
+
+func TestSearchAfterConnectionClosed(t *testing.T) {
+	c := &config.LdapConfig{
+		URL:               "127.0.0.1:1",
+		BindDN:            "CN=ro_user,DC=example,DC=org",
+		DefaultAttributes: []string{"operatingSystem"},
+		CacheDir:          t.TempDir(),
+		BaseDnMappings: map[string]*config.BaseDnMapping{
+			"servers": {BaseDnList: []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}}, ExporterPort: 9182},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Invalid configuration: %s", err)
+	}
+	s, err := NewLdapStoreFromConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The connection closed by a reload or the shutdown after the discovery connected is dialed again
+	s.conn = nil
+	if _, err := s.getResults("servers", c.BaseDnMappings["servers"].BaseDnList[0], "(objectClass=computer)", []string{"name"}); err == nil {
+		t.Errorf("Expecting the search to fail as the server can't be reached")
+	}
+	if s.isActiveDirectory() || s.activeDirectory != nil {
+		t.Errorf("Expecting the server not to be detected as ActiveDirectory while it can't be reached")
+	}
+
+	// A reload during the shutdown doesn't close the template refresh channel twice
+	reloadDone := make(chan error)
+	go func() { reloadDone <- s.Reload(c) }()
+	s.Shutdown()
+	if err := <-reloadDone; err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	s.Shutdown()
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/metrics"
+	"go.uber.org/zap"
+)
+
+// hostResolver is the interface used to resolve the target hostnames, which is implemented by
+// net.Resolver
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// dnsResolver is the resolver used to resolve the target hostnames, and can be replaced in tests
+var dnsResolver hostResolver = net.DefaultResolver
+
+// resolveHost returns the IP address of the host, preferring IPv4 addresses.  Hosts which are
+// already IP addresses are returned as-is.
+func resolveHost(ctx context.Context, host string, timeout time.Duration) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return host, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addrs, err := dnsResolver.LookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			return addr, nil
+		}
+	}
+	if len(addrs) == 0 {
+		return "", &net.DNSError{Err: "no addresses found", Name: host, IsNotFound: true}
+	}
+	return addrs[0], nil
+}
+
+// resolveObjects resolves the address of each object concurrently, according to the DNS
+// resolution configuration of the target group.  The lookups which couldn't complete before the
+// deadline of the context are left unresolved, in which case interrupted is true, but the objects
+// are never dropped because of it.
+func (s *LdapStore) resolveObjects(ctx context.Context, targetGroup string, objects []LdapObject) (resolved []LdapObject, interrupted bool) {
+	opts := s.baseDnMapping(targetGroup).DNSResolution
+	if opts == nil {
+		return objects, false
+	}
+
+	lookupInterrupted := make([]bool, len(objects))
+	forEachConcurrently(len(objects), opts.Concurrency, func(i int) {
+		obj := &objects[i]
+		ip, err := resolveHost(ctx, obj.Address, time.Duration(opts.Timeout))
+		if err != nil && ctx.Err() != nil {
+			lookupInterrupted[i] = true
+			obj.DNSResolved = false
+			return
+		}
+		if err != nil {
+			logger.Logger.Debug("Could not resolve target hostname",
+				zap.String("target_group", targetGroup),
+				zap.String("address", obj.Address),
+				zap.String("error", err.Error()))
+			obj.DNSResolved = false
+			return
+		}
+		obj.DNSResolved = true
+		obj.IPAddress = ip
+	})
+
+	kept := []LdapObject{}
+	for i, obj := range objects {
+		interrupted = interrupted || lookupInterrupted[i]
+		if !obj.DNSResolved && !lookupInterrupted[i] && opts.OnFailure == config.DNSOnFailureDrop {
+			metrics.MetricGroupExcludedObjects.WithLabelValues(targetGroup, ExcludeReasonUnresolved).Inc()
+			continue
+		}
+		kept = append(kept, obj)
+	}
+	return kept, interrupted
+}
+
+// forEachConcurrently calls fn for each index from 0 to count-1, with at most concurrency calls
+// running at the same time, and returns once all calls have completed
+func forEachConcurrently(count, concurrency int, fn func(i int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gadelkareem/cachita"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
+// stubResolver resolves hostnames from a static map
+type stubResolver map[string][]string
+
+func (r stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestResolveObjects(t *testing.T) {
+
+	dnsResolver = stubResolver{
+		"host01.example.org": {"fe80::1", "10.0.0.1"},
+		"host02.example.org": {"fe80::2"},
+	}
+	defer func() { dnsResolver = net.DefaultResolver }()
+
+	newObjects := func() []LdapObject {
+		return []LdapObject{
+			{Hostname: "host01", Address: "host01.example.org", Attributes: map[string][]string{}},
+			{Hostname: "host02", Address: "host02.example.org", Attributes: map[string][]string{}},
+			{Hostname: "host03", Address: "host03.example.org", Attributes: map[string][]string{}},
+			{Hostname: "host04", Address: "10.0.0.4", Attributes: map[string][]string{}},
+		}
+	}
+
+	s := newTestStore(t, &config.BaseDnMapping{
+		BaseDnList:    []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+		ExporterPort:  9182,
+		DNSResolution: &config.DNSResolution{UseIPAddress: true, Concurrency: 2},
+	})
+
+	res, interrupted := s.resolveObjects(context.Background(), "test", newObjects())
+	if len(res) != 4 || interrupted {
+		t.Fatalf("Expecting 4 objects, got %d", len(res))
+	}
+
+	expected := []TargetGroup{
+		{Targets: []string{"10.0.0.1:9182"}, Labels: map[string]string{"__meta_ldap_exporter_port_name": "default", "__meta_ldap_dns_resolved": "true", "__meta_ldap_hostname": "host01.example.org", "env": "prod", "team": "global"}},
+		{Targets: []string{"[fe80::2]:9182"}, Labels: map[string]string{"__meta_ldap_exporter_port_name": "default", "__meta_ldap_dns_resolved": "true", "__meta_ldap_hostname": "host02.example.org", "env": "prod", "team": "global"}},
+		{Targets: []string{"host03.example.org:9182"}, Labels: map[string]string{"__meta_ldap_exporter_port_name": "default", "__meta_ldap_dns_resolved": "false", "__meta_ldap_hostname": "host03.example.org", "env": "prod", "team": "global"}},
+		{Targets: []string{"10.0.0.4:9182"}, Labels: map[string]string{"__meta_ldap_exporter_port_name": "default", "__meta_ldap_dns_resolved": "true", "__meta_ldap_hostname": "10.0.0.4", "env": "prod", "team": "global"}},
+	}
+	if tgList := s.buildTargetGroups("test", res); !reflect.DeepEqual(tgList, expected) {
+		t.Errorf("Expecting target groups %+v, got %+v", expected, tgList)
+	}
+
+	s = newTestStore(t, &config.BaseDnMapping{
+		BaseDnList:    []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+		ExporterPort:  9182,
+		DNSResolution: &config.DNSResolution{OnFailure: "drop"},
+	})
+	res, _ = s.resolveObjects(context.Background(), "test", newObjects())
+	if len(res) != 3 || res[2].Hostname != "host04" {
+		t.Errorf("Expecting unresolved object to be dropped, got %+v", res)
+	}
+
+	// Lookups interrupted by the deadline don't drop the objects
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, interrupted = s.resolveObjects(ctx, "test", newObjects())
+	if len(res) != 4 || !interrupted || res[0].DNSResolved || !res[3].DNSResolved {
+		t.Errorf("Expecting interrupted lookups to keep the objects unresolved, got %+v", res)
+	}
+}
+
+func TestInterruptedResolutionCaching(t *testing.T) {
+
+	dnsResolver = stubResolver{"host01.example.org": {"10.0.0.1"}}
+	defer func() { dnsResolver = net.DefaultResolver }()
+
+	s := newTestStore(t, &config.BaseDnMapping{
+		BaseDnList:    []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+		ExporterPort:  9182,
+		DNSResolution: &config.DNSResolution{},
+		Guardrails:    &config.Guardrails{MaxObjects: 10},
+	})
+	s.Config.CacheTTL = 600
+	cache, err := cachita.NewFileCache(t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Could not create cache: %s", err)
+	}
+	c := &ttlCache{Cache: cache, ttls: map[string]time.Duration{}}
+	s.cache = c
+	s.conn = &referralDirectory{results: map[string]*ldap.SearchResult{
+		"OU=Servers,DC=example,DC=org": {Entries: []*ldap.Entry{
+			ldap.NewEntry("CN=host01,OU=Servers,DC=example,DC=org", map[string][]string{"name": {"host01"}, "dNSHostName": {"host01.example.org"}}),
+		}},
+	}}
+
+	// The objects whose lookups were interrupted by the deadline are cached briefly, so that the
+	// refresh converges, but aren't kept as the last accepted refresh of the guardrails
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err := s.runDiscovery(ctx, "test")
+	if err != nil || len(res) != 1 || res[0].DNSResolved {
+		t.Fatalf("Expecting 1 unresolved object, got %+v (%v)", res, err)
+	}
+	if ttl, ok := c.ttls[cacheKey("test")]; !ok || ttl != retryCacheTTL {
+		t.Errorf("Expecting the objects to be cached for %s, got %s (cached: %t)", retryCacheTTL, ttl, ok)
+	}
+	if _, ok := s.snapshots["test"]; ok {
+		t.Errorf("Expecting the interrupted refresh not to be kept for the guardrails")
+	}
+
+	// A complete refresh is cached for the configured TTL
+	if err := s.cache.Invalidate(cacheKey("test")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res, err = s.runDiscovery(context.Background(), "test")
+	if err != nil || len(res) != 1 || !res[0].DNSResolved {
+		t.Fatalf("Expecting 1 resolved object, got %+v (%v)", res, err)
+	}
+	if ttl := c.ttls[cacheKey("test")]; ttl != 600*time.Second {
+		t.Errorf("Expecting the objects to be cached for 10m, got %s", ttl)
+	}
+	if _, ok := s.snapshots["test"]; !ok {
+		t.Errorf("Expecting the complete refresh to be kept for the guardrails")
+	}
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/metrics"
+	"go.uber.org/zap"
+)
+
+// SearchStatus holds the outcome of the last search of a base DN, or of a group for the target
+// groups discovering group members
+type SearchStatus struct {
+	DN          string     `json:"dn"`
+	Scope       string     `json:"scope,omitempty"`
+	Filter      string     `json:"filter,omitempty"`
+	Failed      bool       `json:"failed"`
+	LastAttempt time.Time  `json:"last_attempt"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	// NumObjects is the number of objects returned by the last successful search
+	NumObjects int `json:"num_objects"`
+	// Stale is set when the objects of the last successful search are served in place of the failed one
+	Stale bool `json:"stale"`
+}
+
+// searchErrors holds the errors of the failed searches of a target group, by base DN
+type searchErrors map[string]error
+
+func (e searchErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for dn, err := range e {
+		msgs = append(msgs, dn+": "+err.Error())
+	}
+	sort.Strings(msgs)
+	return strings.Join(msgs, "; ")
+}
+
+// searchKey identifies a search of a target group, as the same base DN can be listed several times
+// with a different scope or filter
+type searchKey struct {
+	dn     string
+	scope  string
+	filter string
+}
+
+type searchSnapshot struct {
+	status  SearchStatus
+	objects []LdapObject
+}
+
+// recordSearch records the outcome of the search of a base DN of the target group and returns the
+// objects to serve for it: the objects found when the search succeeded, or the objects of the last
+// successful search otherwise
+func (s *LdapStore) recordSearch(targetGroup string, key searchKey, objects []LdapObject, err error) []LdapObject {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	if s.searches == nil {
+		s.searches = map[string]map[searchKey]*searchSnapshot{}
+	}
+	if s.searches[targetGroup] == nil {
+		s.searches[targetGroup] = map[searchKey]*searchSnapshot{}
+	}
+	snapshot, ok := s.searches[targetGroup][key]
+	if !ok {
+		snapshot = &searchSnapshot{status: SearchStatus{DN: key.dn, Scope: key.scope, Filter: key.filter}}
+		s.searches[targetGroup][key] = snapshot
+	}
+	dn := key.dn
+
+	now := nowFunc()
+	snapshot.status.LastAttempt = now
+	if err == nil {
+		snapshot.status.Failed = false
+		snapshot.status.Stale = false
+		snapshot.status.LastError = ""
+		snapshot.status.LastSuccess = &now
+		snapshot.status.NumObjects = len(objects)
+		snapshot.objects = objects
+		metrics.MetricSearchFailed.WithLabelValues(targetGroup, dn).Set(0)
+		metrics.MetricSearchLastSuccess.WithLabelValues(targetGroup, dn).Set(float64(now.Unix()))
+		return objects
+	}
+
+	snapshot.status.Failed = true
+	snapshot.status.LastError = err.Error()
+	snapshot.status.Stale = snapshot.status.LastSuccess != nil
+	metrics.MetricSearchFailed.WithLabelValues(targetGroup, dn).Set(1)
+	if snapshot.status.Stale {
+		logger.Logger.Warn("Serving the objects of the last successful search of the failed base DN",
+			zap.String("target_group", targetGroup),
+			zap.String("dn", dn),
+			zap.Time("last_success", *snapshot.status.LastSuccess),
+			zap.Int("num_objects", len(snapshot.objects)))
+	}
+	return snapshot.objects
+}
+
+// Status returns the outcome of the last search of each base DN of each target group, sorted by DN,
+// scope and filter
+func (s *LdapStore) Status() map[string][]SearchStatus {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	status := map[string][]SearchStatus{}
+	for targetGroup, snapshots := range s.searches {
+		list := make([]SearchStatus, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			list = append(list, snapshot.status)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].DN != list[j].DN {
+				return list[i].DN < list[j].DN
+			}
+			if list[i].Scope != list[j].Scope {
+				return list[i].Scope < list[j].Scope
+			}
+			return list[i].Filter < list[j].Filter
+		})
+		status[targetGroup] = list
+	}
+	return status
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRecordSearch(t *testing.T) {
+
+	nowFunc = func() time.Time { return time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC) }
+	defer func() { nowFunc = time.Now }()
+
+	s := &LdapStore{shared: &shared{}}
+	servers := searchKey{dn: "OU=Servers,DC=example,DC=org", filter: "(objectClass=computer)"}
+	desktops := searchKey{dn: "OU=Desktops,DC=example,DC=org", filter: "(objectClass=computer)"}
+	// The same base DN searched with another scope has its own status
+	serversOne := searchKey{dn: servers.dn, scope: "one", filter: servers.filter}
+
+	// A failed search without a previous successful search returns no objects
+	if res := s.recordSearch("test", desktops, []LdapObject{}, errors.New("timeout")); len(res) != 0 {
+		t.Errorf("Expecting no objects, got %d", len(res))
+	}
+	if res := s.recordSearch("test", servers, testObjects(3), nil); len(res) != 3 {
+		t.Errorf("Expecting 3 objects, got %d", len(res))
+	}
+	// The objects of the last successful search are returned when the search fails
+	if res := s.recordSearch("test", servers, []LdapObject{}, errors.New("timeout")); len(res) != 3 {
+		t.Errorf("Expecting the 3 previous objects, got %d", len(res))
+	}
+	if res := s.recordSearch("test", serversOne, testObjects(1), nil); len(res) != 1 {
+		t.Errorf("Expecting 1 object, got %d", len(res))
+	}
+
+	status := s.Status()["test"]
+	if len(status) != 3 {
+		t.Fatalf("Expecting the status of 3 searches, got %d", len(status))
+	}
+	if status[0].DN != desktops.dn || !status[0].Failed || status[0].Stale || status[0].LastSuccess != nil {
+		t.Errorf("Unexpected status for %s: %+v", desktops, status[0])
+	}
+	if status[1].DN != servers.dn || status[1].Scope != "" || !status[1].Failed || !status[1].Stale || status[1].LastSuccess == nil ||
+		status[1].NumObjects != 3 || status[1].LastError != "timeout" {
+		t.Errorf("Unexpected status for %s: %+v", servers.dn, status[1])
+	}
+	if status[2].DN != servers.dn || status[2].Scope != "one" || status[2].Failed || status[2].NumObjects != 1 {
+		t.Errorf("Unexpected status for %s with the one scope: %+v", servers.dn, status[2])
+	}
+}
+
+func TestSearchErrors(t *testing.T) {
+	errs := searchErrors{
+		"OU=Servers,DC=example,DC=org":  errors.New("timeout"),
+		"OU=Desktops,DC=example,DC=org": errors.New("no such object"),
+	}
+	expected := "OU=Desktops,DC=example,DC=org: no such object; OU=Servers,DC=example,DC=org: timeout"
+	if errs.Error() != expected {
+		t.Errorf("Expecting %q, got %q", expected, errs.Error())
+	}
+}
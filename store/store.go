@@ -1,7 +1,14 @@
 package store
 
+import (
+	"context"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+)
+
 type DataStore interface {
-	Serialize(string) (string, error)
+	Serialize(context.Context, string) (string, error)
+	GeneratedGroups() map[string]*config.BaseDnMapping
 	IsReady() bool
 	Shutdown()
 }
@@ -0,0 +1,219 @@
+package store
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/logger"
+	"github.com/hartfordfive/prometheus-ldap-sd-server/metrics"
+	promlabels "github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"go.uber.org/zap"
+)
+
+// objectAddress returns the host part of the targets generated for the LDAP object.  The
+// address_template of the target group is used when set, otherwise the first hostname source
+// with a value is used.
+func (s *LdapStore) objectAddress(targetGroup string, obj LdapObject) string {
+	baseDnMapping := s.baseDnMapping(targetGroup)
+	if baseDnMapping.AddressTemplate == "" {
+		for _, h := range baseDnMapping.HostnameSources {
+			if value := strings.TrimSpace(obj.Attribute(h.Attribute)); value != "" {
+				return value + h.Suffix
+			}
+		}
+		return ""
+	}
+
+	address, err := baseDnMapping.RenderAddress(obj.firstValues())
+	if err != nil {
+		logger.Logger.Warn("Could not render address template",
+			zap.String("target_group", targetGroup),
+			zap.String("name", obj.Hostname),
+			zap.String("error", err.Error()))
+		return ""
+	}
+	return address
+}
+
+// targetHost returns the host used in the target addresses of the object, which is the resolved
+// IP address when the group is configured to use it
+func targetHost(baseDnMapping *config.BaseDnMapping, obj LdapObject) string {
+	if baseDnMapping.DNSResolution != nil && baseDnMapping.DNSResolution.UseIPAddress && obj.IPAddress != "" {
+		return obj.IPAddress
+	}
+	return obj.Address
+}
+
+// objectPort returns the exporter port of the LDAP object, read from the port attribute when
+// configured and falling back to the static port.  A value of 0 means no valid port was found.
+func objectPort(port *config.ExporterPort, obj LdapObject) int {
+	if port.PortAttribute != "" {
+		if p, err := strconv.Atoi(strings.TrimSpace(obj.Attribute(port.PortAttribute))); err == nil && p >= 1 && p <= 65535 {
+			return p
+		}
+	}
+	return port.Port
+}
+
+// buildTargetGroups builds the list of target groups served for the discovered LDAP objects
+func (s *LdapStore) buildTargetGroups(targetGroup string, res []LdapObject) []TargetGroup {
+	tgList := []TargetGroup{}
+
+	baseDnMapping := s.baseDnMapping(targetGroup)
+	labelAttributes := append(append([]string{}, s.Config.DefaultAttributes...), baseDnMapping.Attributes...)
+
+	for _, ldapObject := range res {
+
+		address := targetHost(baseDnMapping, ldapObject)
+		if address == "" {
+			continue
+		}
+		dnsResolution := baseDnMapping.DNSResolution
+
+		labels := map[string]string{}
+		for k, values := range ldapObject.Attributes {
+			opts := baseDnMapping.AttributeOptions[k]
+
+			// DN labels are extracted even if the attribute itself isn't exposed as a label
+			dnLabelSet, err := dnLabels(k, ldapObject.Attribute(k), opts)
+			if err != nil {
+				logger.Logger.Debug("Could not parse DN attribute",
+					zap.String("target_group", targetGroup),
+					zap.String("name", ldapObject.Hostname),
+					zap.String("attribute", k),
+					zap.String("error", err.Error()))
+			}
+			for labelName, v := range dnLabelSet {
+				labels[labelName] = v
+			}
+
+			if isBaseAttribute(k, baseAttributes) || !isBaseAttribute(k, labelAttributes) {
+				continue
+			}
+			for labelName, v := range attributeLabels(k, values, opts, s.Config.AttributeDecoding(k, opts)) {
+				if _, ok := labels[labelName]; !ok {
+					labels[labelName] = v
+				}
+			}
+		}
+
+		for k, v := range labels {
+			if value, keep := sanitizeLabelValue(v, baseDnMapping.InvalidUTF8Values, baseDnMapping.MaxLabelValueLength); keep {
+				labels[k] = value
+			} else {
+				delete(labels, k)
+			}
+		}
+
+		// Each object yields one target for every exporter port of the group
+		for _, port := range baseDnMapping.ExporterPorts {
+			portNum := objectPort(port, ldapObject)
+			if portNum == 0 {
+				logger.Logger.Debug("Skipping target as no valid exporter port was found",
+					zap.String("target_group", targetGroup),
+					zap.String("name", ldapObject.Hostname),
+					zap.String("port_name", port.Name))
+				continue
+			}
+
+			tgLabels := map[string]string{}
+			for k, v := range labels {
+				tgLabels[k] = v
+			}
+			tgLabels[labelExporterPort] = port.Name
+			if dnsResolution != nil {
+				tgLabels[labelDNSResolved] = strconv.FormatBool(ldapObject.DNSResolved)
+				// The hostname is kept as a label when it's replaced by the IP in the address
+				if dnsResolution.UseIPAddress {
+					tgLabels[labelHostname] = ldapObject.Address
+				}
+			}
+			// The targets whose probe was interrupted by the request deadline are left unlabelled
+			if reachable, ok := ldapObject.Reachable[port.Name]; ok && baseDnMapping.ExporterProbe != nil {
+				tgLabels[labelReachable] = strconv.FormatBool(reachable)
+			}
+
+			// Static labels of the target group take precedence over the global ones
+			for k, v := range s.Config.Labels {
+				tgLabels[k] = v
+			}
+			for k, v := range baseDnMapping.Labels {
+				tgLabels[k] = v
+			}
+
+			tgLabels[labelAddress] = net.JoinHostPort(address, strconv.Itoa(portNum))
+
+			lb := promlabels.NewBuilder(promlabels.FromMap(tgLabels))
+			if !relabel.ProcessBuilder(lb, baseDnMapping.RelabelConfigs...) {
+				continue
+			}
+			tgLabels = lb.Labels().Map()
+			if tgLabels[labelAddress] == "" {
+				continue
+			}
+
+			tg := TargetGroup{
+				Targets: []string{tgLabels[labelAddress]},
+				Labels:  tgLabels,
+			}
+			delete(tg.Labels, labelAddress)
+
+			tgList = append(tgList, tg)
+		}
+	}
+
+	if baseDnMapping.Deduplicate.Key == config.DedupKeyAddress {
+		var removed int
+		tgList, removed = deduplicateTargetGroups(tgList, baseDnMapping.Deduplicate.LabelConflicts)
+		metrics.MetricGroupDuplicatesRemoved.WithLabelValues(targetGroup).Set(float64(removed))
+	}
+
+	if baseDnMapping.CoalesceTargets {
+		tgList = coalesceTargetGroups(tgList)
+	}
+
+	return tgList
+}
+
+// labelSetKey returns a string uniquely identifying the given set of labels
+func labelSetKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString(k)
+		b.WriteByte('\xff')
+		b.WriteString(labels[k])
+		b.WriteByte('\xff')
+	}
+	return b.String()
+}
+
+// coalesceTargetGroups merges the target groups sharing an identical label set into a single
+// target group.  The order in which each label set is first seen is preserved.
+func coalesceTargetGroups(tgList []TargetGroup) []TargetGroup {
+	coalesced := []TargetGroup{}
+	index := map[string]int{}
+
+	for _, tg := range tgList {
+		key := labelSetKey(tg.Labels)
+		if i, ok := index[key]; ok {
+			coalesced[i].Targets = append(coalesced[i].Targets, tg.Targets...)
+			continue
+		}
+		index[key] = len(coalesced)
+		coalesced = append(coalesced, TargetGroup{
+			Targets: append([]string{}, tg.Targets...),
+			Labels:  tg.Labels,
+		})
+	}
+	return coalesced
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hartfordfive/prometheus-ldap-sd-server/config"
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+func TestCoalesceTargetGroups(t *testing.T) {
+
+	tgList := []TargetGroup{
+		{Targets: []string{"host1:9182"}, Labels: map[string]string{"__meta_ldap_operating_system": "Windows 10"}},
+		{Targets: []string{"host2:9182"}, Labels: map[string]string{"__meta_ldap_operating_system": "Windows 11"}},
+		{Targets: []string{"host3:9182"}, Labels: map[string]string{"__meta_ldap_operating_system": "Windows 10"}},
+		{Targets: []string{"host4:9182"}, Labels: map[string]string{}},
+	}
+
+	expected := []TargetGroup{
+		{Targets: []string{"host1:9182", "host3:9182"}, Labels: map[string]string{"__meta_ldap_operating_system": "Windows 10"}},
+		{Targets: []string{"host2:9182"}, Labels: map[string]string{"__meta_ldap_operating_system": "Windows 11"}},
+		{Targets: []string{"host4:9182"}, Labels: map[string]string{}},
+	}
+
+	res := coalesceTargetGroups(tgList)
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expecting coalesced target groups %+v, got %+v", expected, res)
+	}
+
+	// Label sets with the same values but different names must not be merged
+	tgList = []TargetGroup{
+		{Targets: []string{"host1:9182"}, Labels: map[string]string{"a": "b"}},
+		{Targets: []string{"host2:9182"}, Labels: map[string]string{"ab": ""}},
+	}
+	if res := coalesceTargetGroups(tgList); len(res) != 2 {
+		t.Errorf("Expecting 2 target groups, got %d", len(res))
+	}
+}
+
+func newTestStore(t *testing.T, mapping *config.BaseDnMapping) *LdapStore {
+	if err := mapping.Validate("test"); err != nil {
+		t.Fatalf("Invalid target group configuration: %s", err)
+	}
+	return &LdapStore{
+		Config: &config.LdapConfig{
+			DefaultAttributes: []string{"operatingSystem"},
+			BaseDnMappings:    map[string]*config.BaseDnMapping{"test": mapping},
+			Labels:            map[string]string{"env": "prod", "team": "global"},
+		},
+		shared: &shared{},
+	}
+}
+
+func TestBuildTargetGroups(t *testing.T) {
+
+	var relabelConfigs []*relabel.Config
+	err := yaml.Unmarshal([]byte(`
+- source_labels: [__meta_ldap_operating_system]
+  regex: "Windows 10.*"
+  action: drop
+- source_labels: [__address__]
+  regex: "([^.]+)\\..*"
+  target_label: instance`), &relabelConfigs)
+	if err != nil {
+		t.Fatalf("Could not unmarshal relabel configs: %s", err)
+	}
+
+	s := newTestStore(t, &config.BaseDnMapping{
+		BaseDnList: []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+		ExporterPorts: []*config.ExporterPort{
+			{Name: "windows", Port: 9182},
+			{Name: "app", Port: 9500, PortAttribute: "extensionAttribute1"},
+		},
+		Labels:         map[string]string{"team": "servers"},
+		RelabelConfigs: relabelConfigs,
+	})
+
+	objects := []LdapObject{
+		{Hostname: "srv01", Attributes: map[string][]string{"name": {"srv01"}, "dNSHostName": {"srv01.example.org"}, "operatingSystem": {"Windows Server 2019"}, "extensionAttribute1": {"9600"}}},
+		{Hostname: "desk01", Attributes: map[string][]string{"name": {"desk01"}, "dNSHostName": {"desk01.example.org"}, "operatingSystem": {"Windows 10 Pro"}}},
+	}
+
+	expected := []TargetGroup{
+		{
+			Targets: []string{"srv01.example.org:9182"},
+			Labels: map[string]string{
+				"__meta_ldap_operating_system":   "Windows Server 2019",
+				"__meta_ldap_exporter_port_name": "windows",
+				"env":                            "prod",
+				"team":                           "servers",
+				"instance":                       "srv01",
+			},
+		},
+		{
+			Targets: []string{"srv01.example.org:9600"},
+			Labels: map[string]string{
+				"__meta_ldap_operating_system":   "Windows Server 2019",
+				"__meta_ldap_exporter_port_name": "app",
+				"env":                            "prod",
+				"team":                           "servers",
+				"instance":                       "srv01",
+			},
+		},
+	}
+
+	for i := range objects {
+		objects[i].Address = s.objectAddress("test", objects[i])
+	}
+
+	res := s.buildTargetGroups("test", objects)
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expecting target groups %+v, got %+v", expected, res)
+	}
+}
+
+func TestObjectAddress(t *testing.T) {
+
+	s := newTestStore(t, &config.BaseDnMapping{
+		BaseDnList:   []*config.BaseDn{{DN: "OU=Servers,DC=example,DC=org"}},
+		ExporterPort: 9182,
+		HostnameSources: []*config.HostnameSource{
+			{Attribute: "dNSHostName"},
+			{Attribute: "name", Suffix: ".corp.example.org"},
+			{Attribute: "ipHostNumber"},
+		},
+	})
+
+	tests := []struct {
+		attributes map[string][]string
+		expected   string
+	}{
+		{map[string][]string{"dNSHostName": {"host01.example.org"}, "name": {"host01"}}, "host01.example.org"},
+		{map[string][]string{"dNSHostName": {}, "name": {"host01"}}, "host01.corp.example.org"},
+		{map[string][]string{"ipHostNumber": {"10.0.0.1"}}, "10.0.0.1"},
+		{map[string][]string{"dNSHostName": {""}}, ""},
+	}
+	for i, test := range tests {
+		if res := s.objectAddress("test", LdapObject{Attributes: test.attributes}); res != test.expected {
+			t.Errorf("Test %d: expecting address %q, got %q", i, test.expected, res)
+		}
+	}
+}